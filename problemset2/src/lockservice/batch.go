@@ -0,0 +1,71 @@
+package lockservice
+
+//
+// Batches of ops.
+//
+// Agreeing on an instance takes at least one round of RPCs to a majority,
+// so rather than one op per instance, a LockService proposes every request
+// queued while it was busy as one batch, up to maxBatch ops. Every replica
+// applies the ops of a decided batch in order, as if each had its own
+// instance; they share the instance's number, so a lease or session that
+// starts in the batch starts at that instance. Fencing tokens and places
+// in line are counted separately, so that every grant still gets a higher
+// token than the last, and a client that gets in line is behind every
+// client that got in line before it, even in the same batch.
+//
+// In a rolling upgrade that bumps batchVersion, a replica still on the old
+// release stops applying at the first batch of the new version rather
+// than let its state drift from that of the others. It keeps taking part
+// in Paxos, so the cluster keeps its majority, and it stays up, so it
+// doesn't crash and replay into the same batch again; requests sent to it
+// reply Unavailable, and its clients go on to the upgraded replicas. It
+// catches up once it is restarted on the new release.
+//
+
+// The most ops I propose for one instance.
+const maxBatch = 64
+
+// The version of a batch of Ops, to be bumped whenever the fields of Op
+// change. A replica refuses to apply a batch of a later version than its
+// own.
+const batchVersion = 1
+
+// Encodes the batch of ops proposed for an instance.
+var opsCodec = GobCodec[[]Op]{batchVersion}
+
+// Returns the ops of batch, in order.
+func requestOps(batch []*Request) []Op {
+	ops := make([]Op, len(batch))
+	for i, request := range batch {
+		ops[i] = request.Op
+	}
+	return ops
+}
+
+// Returns whether a and b hold the same ops in the same order.
+func sameOps(a []Op, b []Op) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the ops decoded from a decided value, given the result of
+// decoding it. A value that isn't a batch at all is a Noop, on every
+// replica alike. Returns an error for a batch of a later version, which
+// this release can't apply safely.
+func decodedOps(ops []Op, err error) ([]Op, error) {
+	if err == nil {
+		return ops, nil
+	}
+	if _, later := err.(*VersionError); later {
+		return nil, err
+	}
+	DPrintf("decodedOps(): not a batch of Ops: %v\n", err)
+	return []Op{{OpType: Noop}}, nil
+}
@@ -0,0 +1,71 @@
+package lockservice
+
+import "testing"
+import "time"
+
+// Clients that get in line in the same batch are granted in the order of
+// the batch.
+func TestLineOrderWithinBatch(t *testing.T) {
+	sim, _, services := makeSimCluster(5, 1)
+	ls := services[0]
+	commit := func(ops ...Op) {
+		ls.mu.Lock()
+		instance := ls.max + 1
+		ls.mu.Unlock()
+		ls.px.Start(instance, ops)
+		ls.mu.Lock()
+		for ls.max < instance {
+			ls.changed.Wait()
+		}
+		ls.mu.Unlock()
+	}
+	sim.Go(func() {
+		commit(Op{OpType: Lock, Client: 1, Lock: "/t/y"})
+		commit(Op{OpType: Lock, Client: 2, Lock: "/t/y"}, Op{OpType: Lock, Client: 3, Lock: "/t", Subtree: true})
+		commit(Op{OpType: Unlock, Client: 1, Lock: "/t/y"})
+	})
+	sim.Run(10 * time.Second)
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if owner := ls.locks["/t/y"]; owner != 2 {
+		t.Fatalf("/t/y went to %v, want 2, which got in line first", owner)
+	}
+	if _, held := ls.locks["/t"]; held {
+		t.Fatalf("/t was granted while 2 holds /t/y")
+	}
+}
+
+// Replicas stop before a batch from a later release, without crashing, and
+// tell their clients they can't serve.
+func TestLaterBatchStopsReplicas(t *testing.T) {
+	sim, servers, services := makeSimCluster(6, 3)
+	lc := sim.MakeLockClient(servers...)
+	var before, after Err
+	sim.Go(func() {
+		_, before = lc.Lock("/a")
+		ls := services[0]
+		ls.mu.Lock()
+		instance := ls.max + 1
+		ls.mu.Unlock()
+		ls.px.Paxos.Start(instance, []byte{batchVersion + 1})
+		_, after = lc.Lock("/b")
+	})
+	sim.Run(60 * time.Second)
+
+	if before != OK || after != ConnectionFailure {
+		t.Fatalf("Lock before = %v, after = %v; want OK, ConnectionFailure", before, after)
+	}
+	for i, ls := range services {
+		ls.mu.Lock()
+		max := ls.max
+		ls.mu.Unlock()
+		if decided, _ := ls.px.Paxos.Status(max + 1); !decided {
+			t.Fatalf("n%v stopped at %v, before an undecided instance", i, max)
+		}
+		if _, ops, err := ls.px.Status(max + 1); err == nil {
+			t.Fatalf("n%v stopped before instance %v, which holds %v", i, max+1, ops)
+		}
+	}
+	checkReplicasAgree(t, services)
+}
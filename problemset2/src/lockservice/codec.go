@@ -0,0 +1,110 @@
+package lockservice
+
+//
+// Typed values for Paxos.
+//
+// Paxos agrees on opaque byte strings. A TypedPaxos wraps a Paxos peer so
+// an application proposes and learns values of its own type T, turned
+// into bytes and back by a Codec. Status returns an error rather than
+// panicking for a value it can't decode.
+//
+// GobCodec encodes a value with gob behind a one-byte version. An
+// application bumps the version whenever it changes T: gob fills fields
+// a value lacks with zero values and skips fields T lacks, so a release
+// still decodes the values of every earlier version, but refuses values
+// of a later version, which may mean something it doesn't understand.
+//
+
+import "bytes"
+import "encoding/gob"
+import "fmt"
+
+// Turns values of type T into bytes and back.
+type Codec[T any] interface {
+	Encode(v T) ([]byte, error)
+	Decode(data []byte) (T, error)
+}
+
+// A Codec that encodes values of type T with gob, tagged with Version.
+type GobCodec[T any] struct {
+	Version byte
+}
+
+// Returned by Decode for a value of a later version than the codec's.
+type VersionError struct {
+	Version byte // The version of the value.
+	Known   byte // The latest version the codec decodes.
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("value has version %v, but only versions up to %v are known", e.Version, e.Known)
+}
+
+func (c GobCodec[T]) Encode(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(c.Version)
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c GobCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	if len(data) == 0 {
+		return v, fmt.Errorf("empty value")
+	}
+	if data[0] > c.Version {
+		return v, &VersionError{data[0], c.Version}
+	}
+	err := gob.NewDecoder(bytes.NewReader(data[1:])).Decode(&v)
+	return v, err
+}
+
+// A Paxos peer that agrees on values of type T.
+type TypedPaxos[T any] struct {
+	*Paxos
+	codec Codec[T]
+}
+
+func MakeTypedPaxos[T any](px *Paxos, codec Codec[T]) *TypedPaxos[T] {
+	return &TypedPaxos[T]{px, codec}
+}
+
+// Starts agreement on v for instance seq. Panics if v can't be encoded.
+func (tp *TypedPaxos[T]) Start(seq int, v T) {
+	data, err := tp.codec.Encode(v)
+	if err != nil {
+		panic(fmt.Sprintf("Encoding %v: %v", v, err))
+	}
+	tp.Paxos.Start(seq, data)
+}
+
+// Returns whether seq has been decided, and if so the decided value, or
+// an error if it can't be decoded.
+func (tp *TypedPaxos[T]) Status(seq int) (bool, T, error) {
+	var v T
+	decided, data := tp.Paxos.Status(seq)
+	if !decided {
+		return false, v, nil
+	}
+	v, err := tp.codec.Decode(data)
+	return true, v, err
+}
+
+// Waits until seq is decided, and returns the decided value, or an error
+// if it can't be decoded. Returns false if seq is forgotten first.
+func (tp *TypedPaxos[T]) Wait(seq int) (bool, T, error) {
+	var v T
+	decided, data := tp.Paxos.Wait(seq)
+	if !decided {
+		return false, v, nil
+	}
+	v, err := tp.codec.Decode(data)
+	return true, v, err
+}
+
+// Decodes a value decided by Paxos.
+func (tp *TypedPaxos[T]) Decode(data []byte) (T, error) {
+	return tp.codec.Decode(data)
+}
@@ -0,0 +1,71 @@
+package lockservice
+
+import "os"
+import "path/filepath"
+import "reflect"
+import "strings"
+import "testing"
+import "time"
+
+// A codec decodes values of its own version and refuses later ones.
+func TestGobCodecVersions(t *testing.T) {
+	want := []Op{{OpType: Lock, Client: 1, Lock: "/a"}, {OpType: Unlock, Client: 2, Lock: "/b"}}
+	data, err := opsCodec.Encode(want)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if got, err := opsCodec.Decode(data); err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("Decode = %v, %v; want %v", got, err, want)
+	}
+
+	data[0] = batchVersion + 1
+	_, err = opsCodec.Decode(data)
+	if verr, ok := err.(*VersionError); !ok || verr.Version != batchVersion+1 || verr.Known != batchVersion {
+		t.Fatalf("Decode of a later version = %v, want a VersionError", err)
+	}
+}
+
+// A peer refuses to replay a log from a later release.
+func TestWalRefusesLaterVersion(t *testing.T) {
+	dir := t.TempDir()
+	header := append([]byte(walMagic), walVersion+1)
+	if err := os.WriteFile(filepath.Join(dir, walFile), header, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	w, err := openWal(dir)
+	if err != nil {
+		t.Fatalf("openWal: %v", err)
+	}
+	defer w.close()
+	err = w.replay(func(*walRecord) { t.Fatalf("replayed a record of a later version") })
+	if err == nil || !strings.Contains(err.Error(), "version") {
+		t.Fatalf("replay = %v, want a version error", err)
+	}
+}
+
+// A LockService refuses to load a snapshot from a later release.
+func TestSnapshotRefusesLaterVersion(t *testing.T) {
+	dir := t.TempDir()
+	sim, _, services := makeSimCluster(1, 1)
+	sim.Run(time.Second)
+	if err := writeSnapshot(dir, replicaState(services[0])); err != nil {
+		t.Fatalf("writeSnapshot: %v", err)
+	}
+	if snapshot, err := readSnapshot(dir); err != nil || snapshot == nil {
+		t.Fatalf("readSnapshot = %v, %v", snapshot, err)
+	}
+
+	path := filepath.Join(dir, snapshotFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	data[len(snapshotMagic)] = snapshotVersion + 1
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if snapshot, err := readSnapshot(dir); err == nil || !strings.Contains(err.Error(), "version") {
+		t.Fatalf("readSnapshot = %v, %v; want a version error", snapshot, err)
+	}
+}
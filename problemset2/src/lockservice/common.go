@@ -1,64 +1,115 @@
 package lockservice
 
-import "net/rpc"
-import "fmt"
+import "time"
 
 const (
 	OK                = "OK"
 	NotLocked         = "NotLocked"
 	NotYourLock       = "NotYourLock"
 	ConnectionFailure = "ConnectionFailure"
+	AlreadyMember     = "AlreadyMember"
+	NotMember         = "NotMember"
+	LastMember        = "LastMember"
+	Expired           = "Expired"
+	SessionExpired    = "SessionExpired"
+	Locked            = "Locked"
+	Timeout           = "Timeout"
+	BadLockName       = "BadLockName"
+	Duplicate         = "Duplicate"
+	Canceled          = "Canceled"
+	Unavailable       = "Unavailable"
 )
 
 type Err string
 
 type LockArgs struct {
-	Client int
-	Lock   int
+	Client  int
+	Lock    string
+	Lease   time.Duration // Released unless renewed within this long, or 0 to hold until unlocked.
+	Session bool          // The client opened a session, which must still be open.
+	Try     bool          // Fail with Locked rather than wait if the lock is held.
+	Timeout time.Duration // Fail with Timeout if not granted within this long, or 0 to wait for ever.
+	Shared  bool          // Lock in shared mode.
+	Subtree bool          // Also lock everything below Lock in the hierarchy.
+	Seq     int           // The client's number for this request, the same in every retry.
+	Acked   int           // The client has had replies to every request up to Acked.
 }
 
 type LockReply struct {
-	Err Err
+	Err   Err
+	Token int // Fencing token: higher for every later grant of any lock.
 }
 
 type UnlockArgs struct {
 	Client int
-	Lock   int
+	Lock   string
+	Seq    int
+	Acked  int
 }
 
 type UnlockReply struct {
 	Err Err
 }
 
-//
-// call() sends an RPC to the rpcname handler on server srv
-// with arguments args, waits for the reply, and leaves the
-// reply in reply. the reply argument should be a pointer
-// to a reply structure.
-//
-// the return value is true if the server responded, and false
-// if call() was not able to contact the server. in particular,
-// the reply's contents are only valid if call() returned true.
-//
-// you should assume that call() will time out and return an
-// error after a while if it doesn't get a reply from the server.
-//
-// please use call() to send all RPCs, in client.go and server.go.
-// please don't change this function.
-//
-func call(srv string, rpcname string,
-	args interface{}, reply interface{}) bool {
-	c, errx := rpc.DialHTTP("tcp", srv)
-	if errx != nil {
-		return false
-	}
-	defer c.Close()
-
-	err := c.Call(rpcname, args, reply)
-	if err == nil {
-		return true
-	}
-
-	fmt.Println(err)
-	return false
+type CancelArgs struct {
+	Client int
+	Lock   string
+	Target int // The Seq of the Lock request to cancel.
+	Seq    int
+	Acked  int
+}
+
+type CancelReply struct {
+	Err Err
+}
+
+type MembershipArgs struct {
+	Client int
+	Peer   string
+	Seq    int // The client's number for this request, or 0 for a server joining.
+	Acked  int
+}
+
+type MembershipReply struct {
+	Err Err
+}
+
+type RenewArgs struct {
+	Client int
+	Lock   string
+	Seq    int
+	Acked  int
+}
+
+type RenewReply struct {
+	Err Err
+}
+
+type WatchArgs struct {
+	Lock  string
+	After int // The instance of the last change seen, or -1 for none.
+}
+
+type WatchReply struct {
+	Err   Err
+	Event Event
+}
+
+// A change to the holders of a lock.
+type Event struct {
+	Instance int   // The instance that made the change.
+	Previous int   // The instance of the change before, or -1 if none is remembered.
+	Owner    int   // The client holding the lock exclusively, or Unlocked.
+	Readers  []int // The clients holding the lock in shared mode.
+}
+
+type SessionArgs struct {
+	Client  int
+	Timeout time.Duration // Used by OpenSession.
+	Seq     int
+	Acked   int
+}
+
+type SessionReply struct {
+	Err Err
 }
@@ -0,0 +1,104 @@
+package lockservice
+
+//
+// Exactly-once requests.
+//
+// A client numbers its requests 1, 2, 3, ... and sends a retry of a
+// request with the same number. The log keeps a table of the results of
+// each client's requests, so when a retry is committed after the request
+// itself was, it is given the original result instead of being applied
+// again. With each request the client also says up to which number it
+// has had all its replies; the table forgets those results, and a stray
+// copy of one of those requests committed later is not applied at all.
+//
+// A client's table goes when its session ends, and otherwise once it has
+// sent no request for tableRetention instances, so the tables of clients
+// that have gone away don't pile up in every snapshot. A retry that turns
+// up later than that is applied as a new request.
+//
+
+// How many instances a client's table is kept after its latest request.
+const tableRetention = 4096
+
+// The result of applying an op.
+type Result struct {
+	Err   Err
+	Token int // The fencing token of a successful Lock.
+}
+
+// What the log remembers of a client's requests.
+type ClientTable struct {
+	Acked    int            // The client has had replies to every request up to Acked.
+	Results  map[int]Result // map request number -> its result, for requests after Acked
+	Instance int            // The instance of the client's latest request.
+}
+
+func (table ClientTable) copy() ClientTable {
+	results := make(map[int]Result)
+	for seq, result := range table.Results {
+		results[seq] = result
+	}
+	return ClientTable{table.Acked, results, table.Instance}
+}
+
+// Applies op, unless it is a client request that was applied before, in
+// which case returns the result it had then.
+// Precondition: ls.mu is locked.
+func (ls *LockService) applyOnce(op Op) Result {
+	if op.Seq == 0 {
+		return ls.apply(op)
+	}
+
+	table, exists := ls.tables[op.Client]
+	if !exists {
+		table = ClientTable{0, make(map[int]Result), ls.max}
+	}
+	if op.Seq <= table.Acked {
+		return Result{Duplicate, 0}
+	}
+	result, applied := table.Results[op.Seq]
+	if !applied && op.OpType == Cancel && op.Target > table.Acked {
+		if _, started := table.Results[op.Target]; !started {
+			// The Lock hasn't been committed yet. Give it this result
+			// in advance so it won't be applied when it is.
+			table.Results[op.Target] = Result{Canceled, 0}
+		}
+	}
+	if !applied {
+		result = ls.apply(op)
+		table.Results[op.Seq] = result
+	}
+
+	if op.Acked > table.Acked {
+		for seq := range table.Results {
+			if seq <= op.Acked {
+				delete(table.Results, seq)
+			}
+		}
+		table.Acked = op.Acked
+	}
+	table.Instance = ls.max
+	ls.tables[op.Client] = table
+	return result
+}
+
+// Forgets the tables of clients that have sent no request for
+// tableRetention instances.
+// Precondition: ls.mu is locked.
+func (ls *LockService) pruneTables() {
+	for client, table := range ls.tables {
+		if ls.max-table.Instance > tableRetention {
+			delete(ls.tables, client)
+		}
+	}
+}
+
+// Applies op to the local state.
+// Precondition: ls.mu is locked.
+func (ls *LockService) apply(op Op) Result {
+	err := ls.applyOperation(op)
+	if op.OpType == Lock && err == OK {
+		return Result{err, ls.tokens[Hold{op.Lock, op.Client}]}
+	}
+	return Result{err, 0}
+}
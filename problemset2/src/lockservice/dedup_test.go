@@ -0,0 +1,81 @@
+package lockservice
+
+import "testing"
+import "time"
+
+// A retry gets the result of the original request, and a stray copy of a
+// request the client has had its reply to is answered Duplicate.
+func TestRetriesApplyOnce(t *testing.T) {
+	sim, servers, services := makeSimCluster(10, 3)
+	lock := func(server string, seq int, acked int) LockReply {
+		var reply LockReply
+		if !sim.Call(server, "LockService.Lock", &LockArgs{Client: 7, Lock: "/a", Seq: seq, Acked: acked}, &reply) {
+			t.Errorf("Lock %v to %v got no reply", seq, server)
+		}
+		return reply
+	}
+	unlock := func(server string, seq int, acked int) Err {
+		var reply UnlockReply
+		if !sim.Call(server, "LockService.Unlock", &UnlockArgs{7, "/a", seq, acked}, &reply) {
+			t.Errorf("Unlock %v to %v got no reply", seq, server)
+		}
+		return reply.Err
+	}
+
+	var first, retry, stray LockReply
+	var unlocked, unlockedAgain Err
+	sim.Go(func() {
+		first = lock(servers[0], 1, 0)
+		retry = lock(servers[1], 1, 0)
+		unlocked = unlock(servers[0], 2, 1)
+		// Retried at another replica after the lock was released.
+		unlockedAgain = unlock(servers[1], 2, 1)
+		// The client has had its reply to 1.
+		stray = lock(servers[2], 1, 0)
+	})
+	sim.Run(30 * time.Second)
+
+	if first.Err != OK || unlocked != OK || unlockedAgain != OK {
+		t.Fatalf("Lock = %v, Unlock = %v, retried Unlock = %v; want OK", first.Err, unlocked, unlockedAgain)
+	}
+	if retry != first {
+		t.Fatalf("retried Lock = %+v, want %+v", retry, first)
+	}
+	if stray.Err != Duplicate {
+		t.Fatalf("stray Lock = %v, want Duplicate", stray.Err)
+	}
+	if state := replicaState(services[0]); len(state.Locks) != 0 {
+		t.Fatalf("locks held after the retries: %v", state.Locks)
+	}
+	checkReplicasAgree(t, services)
+}
+
+// A Cancel committed before the Lock it names keeps that Lock from being
+// applied, and the Lock replies Canceled.
+func TestCancelBeforeLock(t *testing.T) {
+	sim, servers, services := makeSimCluster(11, 3)
+	other := sim.MakeLockClient(servers...)
+
+	var canceled Err
+	var lockReply LockReply
+	var tried Err
+	sim.Go(func() {
+		var reply CancelReply
+		sim.Call(servers[0], "LockService.Cancel", &CancelArgs{Client: 7, Lock: "/a", Target: 1, Seq: 2}, &reply)
+		canceled = reply.Err
+		sim.Call(servers[1], "LockService.Lock", &LockArgs{Client: 7, Lock: "/a", Seq: 1}, &lockReply)
+		_, tried = other.TryLock("/a")
+	})
+	sim.Run(30 * time.Second)
+
+	if canceled != OK {
+		t.Fatalf("Cancel = %v, want OK", canceled)
+	}
+	if lockReply.Err != Canceled {
+		t.Fatalf("Lock after its Cancel = %v, want Canceled", lockReply.Err)
+	}
+	if tried != OK {
+		t.Fatalf("TryLock by another client = %v, want OK", tried)
+	}
+	checkReplicasAgree(t, services)
+}
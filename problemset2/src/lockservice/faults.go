@@ -0,0 +1,193 @@
+package lockservice
+
+//
+// Fault injection for testing. A FaultyNetwork wraps another Transport and
+// applies rules to each directed link between two nodes: messages can be
+// dropped, delayed (which also reorders them), duplicated, or cut off
+// entirely by a one-way partition. Rules can be changed at any time while
+// a cluster is running.
+//
+// fn := MakeFaultyNetwork(MakeMemoryTransport())
+// ls := MakeLockService(servers, i, dir, fn.Transport(servers[i]))
+// fn.Partition(servers[0], servers[1])  -- 0 can no longer reach 1
+// fn.SetDrop(servers[1], servers[2], 0.3)
+// fn.HealAll()
+//
+
+import "reflect"
+import "sync"
+import "time"
+
+type FaultyNetwork struct {
+	mu    sync.Mutex
+	inner Transport
+	rules map[link]*LinkRules
+	nodes map[string]bool // Every node with a Transport on this network.
+	sched Scheduler       // Source of delays, duplicate calls and randomness.
+}
+
+// A directed link between two nodes.
+type link struct {
+	from string
+	to   string
+}
+
+// Faults applied to messages sent over a link.
+type LinkRules struct {
+	DropProbability      float64       // Chance that a message is lost.
+	DuplicateProbability float64       // Chance that a request is delivered twice.
+	Delay                time.Duration // Added to the delivery of every message.
+	Jitter               time.Duration // Random extra delay, up to this much.
+	Partitioned          bool          // Every message is lost.
+}
+
+// A node's view of a FaultyNetwork.
+type faultyTransport struct {
+	network *FaultyNetwork
+	me      string
+}
+
+func MakeFaultyNetwork(inner Transport) *FaultyNetwork {
+	return makeFaultyNetwork(inner, MakeRealScheduler())
+}
+
+func makeFaultyNetwork(inner Transport, sched Scheduler) *FaultyNetwork {
+	fn := new(FaultyNetwork)
+	fn.inner = inner
+	fn.rules = make(map[link]*LinkRules)
+	fn.nodes = make(map[string]bool)
+	fn.sched = sched
+	return fn
+}
+
+// Returns the Transport that node me uses. RPCs it sends to node srv cross
+// the link me -> srv, and their replies cross srv -> me.
+func (fn *FaultyNetwork) Transport(me string) Transport {
+	fn.mu.Lock()
+	fn.nodes[me] = true
+	fn.mu.Unlock()
+	return &faultyTransport{fn, me}
+}
+
+// Returns the rules for the link from -> to, creating them if needed.
+// Precondition: fn.mu is locked.
+func (fn *FaultyNetwork) link(from string, to string) *LinkRules {
+	rules, ok := fn.rules[link{from, to}]
+	if !ok {
+		rules = new(LinkRules)
+		fn.rules[link{from, to}] = rules
+	}
+	return rules
+}
+
+// Drops messages from -> to with probability p.
+func (fn *FaultyNetwork) SetDrop(from string, to string, p float64) {
+	fn.mu.Lock()
+	defer fn.mu.Unlock()
+	fn.link(from, to).DropProbability = p
+}
+
+// Delivers requests from -> to a second time with probability p.
+func (fn *FaultyNetwork) SetDuplicate(from string, to string, p float64) {
+	fn.mu.Lock()
+	defer fn.mu.Unlock()
+	fn.link(from, to).DuplicateProbability = p
+}
+
+// Delays every message from -> to by delay plus a random amount up to
+// jitter.
+func (fn *FaultyNetwork) SetDelay(from string, to string, delay time.Duration, jitter time.Duration) {
+	fn.mu.Lock()
+	defer fn.mu.Unlock()
+	rules := fn.link(from, to)
+	rules.Delay = delay
+	rules.Jitter = jitter
+}
+
+// Cuts the link from -> to. Messages the other way are unaffected.
+func (fn *FaultyNetwork) Partition(from string, to string) {
+	fn.mu.Lock()
+	defer fn.mu.Unlock()
+	fn.link(from, to).Partitioned = true
+}
+
+// Cuts every link into and out of node.
+func (fn *FaultyNetwork) Isolate(node string) {
+	fn.mu.Lock()
+	defer fn.mu.Unlock()
+	for other, _ := range fn.nodes {
+		if other != node {
+			fn.link(node, other).Partitioned = true
+			fn.link(other, node).Partitioned = true
+		}
+	}
+}
+
+// Restores the link from -> to, clearing all of its rules.
+func (fn *FaultyNetwork) Heal(from string, to string) {
+	fn.mu.Lock()
+	defer fn.mu.Unlock()
+	delete(fn.rules, link{from, to})
+}
+
+// Clears every rule on every link.
+func (fn *FaultyNetwork) HealAll() {
+	fn.mu.Lock()
+	defer fn.mu.Unlock()
+	fn.rules = make(map[link]*LinkRules)
+}
+
+// Decides the fate of one message crossing from -> to. Returns whether it
+// is delivered, whether it is duplicated, and how long it is delayed.
+func (fn *FaultyNetwork) cross(from string, to string) (bool, bool, time.Duration) {
+	fn.mu.Lock()
+	defer fn.mu.Unlock()
+	rules, ok := fn.rules[link{from, to}]
+	if !ok {
+		return true, false, 0
+	}
+	if rules.Partitioned || fn.sched.Float64() < rules.DropProbability {
+		return false, false, 0
+	}
+	delay := rules.Delay
+	if rules.Jitter > 0 {
+		delay += time.Duration(fn.sched.Int63n(int64(rules.Jitter)))
+	}
+	return true, fn.sched.Float64() < rules.DuplicateProbability, delay
+}
+
+func (fn *FaultyNetwork) sleep(d time.Duration) {
+	if d > 0 {
+		fn.sched.Sleep(d)
+	}
+}
+
+func (ft *faultyTransport) Call(srv string, rpcname string, args interface{}, reply interface{}) bool {
+	fn := ft.network
+	delivered, duplicated, delay := fn.cross(ft.me, srv)
+	fn.sleep(delay)
+	if !delivered {
+		return false
+	}
+	if duplicated {
+		// The server handles the request twice; only one reply comes back.
+		fn.sched.Go(func() {
+			fn.inner.Call(srv, rpcname, args, newReply(reply))
+		})
+	}
+
+	ok := fn.inner.Call(srv, rpcname, args, reply)
+
+	delivered, _, delay = fn.cross(srv, ft.me)
+	fn.sleep(delay)
+	return ok && delivered
+}
+
+func (ft *faultyTransport) Serve(addr string) (Server, error) {
+	return ft.network.inner.Serve(addr)
+}
+
+// Returns a new zero value of the type reply points to.
+func newReply(reply interface{}) interface{} {
+	return reflect.New(reflect.TypeOf(reply).Elem()).Interface()
+}
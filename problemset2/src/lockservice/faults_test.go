@@ -0,0 +1,103 @@
+package lockservice
+
+import "fmt"
+import "testing"
+import "time"
+
+func TestPartitionAndHeal(t *testing.T) {
+	sim, _, services := makeSimCluster(2, 3)
+	net := sim.Network()
+	net.Partition("n0", "n2")
+	net.Partition("n1", "n2")
+
+	// A client of the minority can't lock until the partition heals, and
+	// is told so rather than kept waiting.
+	minority := sim.MakeLockClient("n2")
+	var minorityErr Err
+	var minorityAt time.Time
+	failures := 0
+	sim.Go(func() {
+		for {
+			_, minorityErr = minority.Lock("/m")
+			minorityAt = sim.Now()
+			if minorityErr != ConnectionFailure {
+				return
+			}
+			failures++
+		}
+	})
+
+	majority := sim.MakeLockClient("n0", "n1")
+	done := 0
+	sim.Go(func() {
+		for i := 0; i < 10; i++ {
+			lock := fmt.Sprintf("/p/%v", i)
+			if _, err := majority.Lock(lock); err != OK {
+				t.Errorf("Lock(%v) = %v in the majority", lock, err)
+			}
+			if err := majority.Unlock(lock); err != OK {
+				t.Errorf("Unlock(%v) = %v in the majority", lock, err)
+			}
+			done++
+		}
+	})
+	sim.Run(30 * time.Second)
+
+	if done != 10 {
+		t.Fatalf("the majority finished %v of 10 rounds", done)
+	}
+	if minorityErr != ConnectionFailure || failures == 0 {
+		t.Fatalf("the minority answered %v while partitioned", minorityErr)
+	}
+
+	healed := sim.Now()
+	net.HealAll()
+	sim.Run(30 * time.Second)
+
+	if minorityErr != OK || minorityAt.Before(healed) {
+		t.Fatalf("the minority answered %v at %v, want OK after %v", minorityErr, minorityAt, healed)
+	}
+	checkReplicasAgree(t, services)
+}
+
+// A client whose first server is cut off from the others is told so, and
+// locks through the next one.
+func TestFailoverFromCutOffServer(t *testing.T) {
+	sim, _, services := makeSimCluster(4, 3)
+	net := sim.Network()
+	net.Partition("n0", "n2")
+	net.Partition("n1", "n2")
+
+	lc := sim.MakeLockClient("n2", "n0", "n1")
+	var err Err
+	sim.Go(func() {
+		_, err = lc.Lock("/b")
+	})
+	sim.Run(30 * time.Second)
+
+	if err != OK {
+		t.Fatalf("Lock = %q, want OK", err)
+	}
+	checkReplicasAgree(t, services[:2])
+}
+
+// A client whose first server has been removed from the cluster locks
+// through the next one, and removing a peer twice still answers NotMember.
+func TestFailoverFromRemovedServer(t *testing.T) {
+	sim, servers, services := makeSimCluster(5, 3)
+	admin := sim.MakeLockClient("n1")
+	lc := sim.MakeLockClient(servers...)
+
+	var removed, again, locked Err
+	sim.Go(func() {
+		removed = admin.RemovePeer("n0")
+		_, locked = lc.Lock("/b")
+		again = lc.RemovePeer("n0")
+	})
+	sim.Run(30 * time.Second)
+
+	if removed != OK || locked != OK || again != NotMember {
+		t.Fatalf("RemovePeer = %v, Lock = %v, RemovePeer again = %v; want OK, OK, NotMember", removed, locked, again)
+	}
+	checkReplicasAgree(t, services[1:])
+}
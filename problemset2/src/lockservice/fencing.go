@@ -0,0 +1,43 @@
+package lockservice
+
+//
+// Fencing tokens.
+//
+// Every successful Lock returns a fencing token: the Paxos instance that
+// granted the lock, or one past the last token when a batch grants
+// several locks in one instance. Tokens of later grants are always
+// higher, so a client that lost its lock (its lease or session expired
+// while it was paused, say) holds a lower token than the client that has
+// the lock now. A resource that records the highest token it has seen can
+// reject writes from such stale holders.
+//
+// fence := MakeFence()
+// token, err := lc.Lock("/billing/invoices/42")
+// ... send token along with each write ...
+// if !fence.Check(token) { reject the write }
+//
+
+import "sync"
+
+// Guards one resource against clients that have lost the lock for it.
+type Fence struct {
+	mu      sync.Mutex
+	highest int // The highest token accepted so far.
+}
+
+func MakeFence() *Fence {
+	return &Fence{highest: -1}
+}
+
+// Returns whether a write carrying token may go ahead: its token must be no
+// lower than any token accepted before. Accepting a token makes every lower
+// one stale.
+func (f *Fence) Check(token int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if token < f.highest {
+		return false
+	}
+	f.highest = token
+	return true
+}
@@ -0,0 +1,118 @@
+package lockservice
+
+//
+// Leases on locks.
+//
+// A client may ask for a lock with a lease: it keeps the lock only as long
+// as it renews the lease within that time. Every replica times the lease
+// from when it committed the grant or the last Renew. Once that time has
+// passed, the Paxos leader proposes an Expire op for that lease; the other
+// members only do so expiryGrace later, in case the leader is down, so a
+// healthy cluster spends one instance on each expiry. The op only releases
+// the lock if it is committed before a later Renew, so all replicas agree
+// on when the lease ended and who holds the lock next, whatever their
+// clocks say.
+//
+// A client should time its lease from when it sent the Lock or Renew, which
+// is never later than when any replica starts timing it.
+//
+
+import "sort"
+import "time"
+
+// How often replicas look for expired leases and sessions.
+const expiryCheckInterval = 50 * time.Millisecond
+
+// How long after a lease or session runs out a member that isn't the
+// leader proposes to end it.
+const expiryGrace = 1 * time.Second
+
+type Lease struct {
+	Duration time.Duration
+	Instance int // The instance that granted or last renewed the lease.
+}
+
+// RPC Handler: Renew the lease of the client on a lock it holds.
+func (ls *LockService) Renew(args *RenewArgs, reply *RenewReply) error {
+	if !ValidLockName(args.Lock) {
+		reply.Err = BadLockName
+		return nil
+	}
+	op := Op{OpType: Renew, Client: args.Client, Lock: args.Lock, Seq: args.Seq, Acked: args.Acked}
+	reply.Err = ls.enqueueRequest(op)
+	return nil
+}
+
+// Applies a Renew or an Expire op committed in instance ls.max.
+// Precondition: ls.mu is locked.
+func (ls *LockService) applyLease(op Op) Err {
+	if !ls.holds(op.Lock, op.Client) {
+		return NotYourLock
+	}
+	hold := Hold{op.Lock, op.Client}
+	lease, leased := ls.leases[hold]
+	if !leased {
+		// The lock is held until it is unlocked.
+		return OK
+	}
+
+	if op.OpType == Renew {
+		ls.leases[hold] = Lease{lease.Duration, ls.max}
+		ls.renewed[hold] = ls.sched.Now()
+		return OK
+	}
+
+	if lease.Instance != op.Instance {
+		// The lease was renewed before it expired.
+		return OK
+	}
+	ls.release(op.Lock, op.Client)
+	return OK
+}
+
+// Proposes an Expire op for every lease, and an ExpireSession op for every
+// session, that has run out by my clock, at once if I lead Paxos and
+// after expiryGrace if not.
+func (ls *LockService) expire() {
+	for {
+		ls.sched.Sleep(expiryCheckInterval)
+
+		var grace time.Duration
+		if ls.px.currentLeader() != ls.me {
+			grace = expiryGrace
+		}
+
+		ls.mu.Lock()
+		if ls.dead {
+			ls.mu.Unlock()
+			return
+		}
+		now := ls.sched.Now()
+		var expired []Op
+		for hold, lease := range ls.leases {
+			if now.Sub(ls.renewed[hold]) > lease.Duration+grace {
+				expired = append(expired, Op{OpType: Expire, Client: hold.Client, Lock: hold.Lock, Instance: lease.Instance})
+			}
+		}
+		for client, session := range ls.sessions {
+			if now.Sub(ls.keptAlive[client]) > session.Timeout+grace {
+				expired = append(expired, Op{OpType: ExpireSession, Client: client, Instance: session.Instance})
+			}
+		}
+		member := ls.config.Contains(ls.me)
+		ls.mu.Unlock()
+
+		if !member {
+			continue
+		}
+		sort.Slice(expired, func(i, j int) bool {
+			if expired[i].Client != expired[j].Client {
+				return expired[i].Client < expired[j].Client
+			}
+			return expired[i].Lock < expired[j].Lock
+		})
+		for _, op := range expired {
+			ls.submitRequest(op, 0)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package lockservice
+
+import "testing"
+import "time"
+
+func TestLeaseExpires(t *testing.T) {
+	sim, servers, services := makeSimCluster(6, 3)
+	holder := sim.MakeLockClient(servers...)
+	waiter := sim.MakeLockClient(servers...)
+
+	begin := sim.Now()
+	var waited time.Duration
+	var holderErr, waiterErr, renewErr Err
+	sim.Go(func() {
+		_, holderErr = holder.LockWithLease("/l", 2*time.Second)
+		// The holder stops renewing, as if it crashed.
+		sim.Sleep(10 * time.Second)
+		renewErr = holder.Renew("/l")
+	})
+	sim.Go(func() {
+		sim.Sleep(100 * time.Millisecond)
+		_, waiterErr = waiter.Lock("/l")
+		waited = sim.Now().Sub(begin)
+	})
+	sim.Run(30 * time.Second)
+
+	if holderErr != OK || waiterErr != OK {
+		t.Fatalf("holder got %v and waiter got %v, want OK", holderErr, waiterErr)
+	}
+	if waited < 2*time.Second || waited > 2*time.Second+expiryGrace {
+		t.Fatalf("waiter got the lock after %v, want soon after the 2s lease ran out", waited)
+	}
+	if renewErr == OK {
+		t.Fatalf("the holder renewed a lease that had run out")
+	}
+	checkReplicasAgree(t, services)
+}
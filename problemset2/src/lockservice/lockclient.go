@@ -1,26 +1,218 @@
 package lockservice
 
 import "math/rand"
+import "reflect"
+import "sync"
 import "time"
 
 type LockClient struct {
-	server   string
-	ClientId int
+	mu        sync.Mutex // Protects current, session, timeout, seq and pending.
+	servers   []string   // Every replica in the cluster.
+	current   int        // The index in servers of the replica that last answered.
+	transport Transport
+	sched     Scheduler // Runs keepalives.
+	ClientId  int
+	session   string        // The state of my session.
+	timeout   time.Duration // The timeout of my latest session.
+	seq       int           // The number of my latest request.
+	pending   map[int]bool  // The numbers of my requests still waiting for replies.
 }
 
-func MakeLockClient(server string) *LockClient {
+// How many times a request is sent to every replica before giving up with
+// ConnectionFailure, and how long to wait between rounds.
+const callAttempts = 3
+const retryInterval = 100 * time.Millisecond
+
+// Session states.
+const (
+	noSession      = ""
+	sessionOpen    = "open"
+	sessionClosed  = "closed"
+	sessionExpired = "expired"
+)
+
+// Creates a client of the cluster of servers. Requests go to the first
+// server until it stops answering, and then to the next that does.
+func MakeLockClient(servers []string, tr Transport) *LockClient {
 	lc := new(LockClient)
-	lc.server = server
+	lc.servers = servers
+	lc.transport = tr
+	lc.sched = MakeRealScheduler()
 	rand.Seed(time.Now().UTC().UnixNano())
 	lc.ClientId = rand.Int()
+	lc.pending = make(map[int]bool)
 	return lc
 }
 
-func (lc *LockClient) Lock(lockId int) Err {
-	args := LockArgs{lc.ClientId, lockId}
+// Numbers a new request. Returns its number, and the number up to which
+// I've had replies to all my requests.
+func (lc *LockClient) begin() (int, int) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.seq++
+	lc.pending[lc.seq] = true
+	acked := lc.seq - 1
+	for seq := range lc.pending {
+		if seq <= acked {
+			acked = seq - 1
+		}
+	}
+	return lc.seq, acked
+}
+
+// Stops waiting for the reply to request seq. It won't be retried after
+// this, so the cluster may forget its result.
+func (lc *LockClient) end(seq int) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	delete(lc.pending, seq)
+}
+
+// Sends an RPC to the replica that last answered, and if no reply comes,
+// retries it at the other replicas in turn. So does a reply of
+// NotMember, from a replica removed from the cluster, or Unavailable, from
+// one that can't get the request agreed on. The replica that replies is
+// the one I use from then on. Requests keep their number in every retry,
+// so the cluster applies each at most once wherever it is retried.
+func (lc *LockClient) call(rpcname string, args interface{}, reply interface{}) bool {
+	lc.mu.Lock()
+	start := lc.current
+	lc.mu.Unlock()
+
+	replied := false
+	for i := 0; i < callAttempts; i++ {
+		if i > 0 {
+			lc.sched.Sleep(retryInterval)
+		}
+		for j := 0; j < len(lc.servers); j++ {
+			server := (start + j) % len(lc.servers)
+			if !lc.transport.Call(lc.servers[server], rpcname, args, reply) {
+				continue
+			}
+			if err := replyErr(reply); err == NotMember || err == Unavailable {
+				replied = err == NotMember
+				continue
+			}
+			lc.mu.Lock()
+			lc.current = server
+			lc.mu.Unlock()
+			return true
+		}
+	}
+	// If the last replica to answer said NotMember, that is the answer:
+	// removing a peer that isn't a member replies NotMember too.
+	return replied
+}
+
+// Returns the Err of an RPC reply, or "" if it has none.
+func replyErr(reply interface{}) Err {
+	field := reflect.ValueOf(reply).Elem().FieldByName("Err")
+	if !field.IsValid() {
+		return ""
+	}
+	return Err(field.String())
+}
+
+// Returns SessionExpired once my session has expired, after which the
+// cluster no longer holds any locks for me.
+func (lc *LockClient) sessionErr() Err {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.session == sessionExpired {
+		return SessionExpired
+	}
+	return ""
+}
+
+// Locks the lock named name, a path such as /billing/invoices/42.
+// Returns the fencing token of the grant, which a resource guarded by the
+// lock can check with a Fence.
+func (lc *LockClient) Lock(name string) (int, Err) {
+	return lc.lock(LockArgs{Lock: name})
+}
+
+// Locks name for as long as the lease is renewed within lease of the
+// previous Lock or Renew. Returns the fencing token of the grant.
+func (lc *LockClient) LockWithLease(name string, lease time.Duration) (int, Err) {
+	return lc.lock(LockArgs{Lock: name, Lease: lease})
+}
+
+// Locks name if it is free. Returns Locked at once if it is held.
+func (lc *LockClient) TryLock(name string) (int, Err) {
+	return lc.lock(LockArgs{Lock: name, Try: true})
+}
+
+// Locks name, waiting at most timeout for it. Returns Timeout if the
+// lock wasn't granted in time; the client is then no longer in line for it.
+// Like a lease, the timeout is timed by the replica's clock from when it
+// gets the request, so the clocks of client and cluster needn't agree.
+func (lc *LockClient) LockTimeout(name string, timeout time.Duration) (int, Err) {
+	return lc.lock(LockArgs{Lock: name, Timeout: timeout})
+}
+
+// Locks name in shared mode, alongside any other clients holding it in
+// shared mode. Unlock releases it as usual.
+func (lc *LockClient) LockShared(name string) (int, Err) {
+	return lc.lock(LockArgs{Lock: name, Shared: true})
+}
+
+// Locks name and every lock below it, such as /billing/invoices/42 below
+// /billing. Waits for any client holding one of them. Unlock of name
+// releases them all.
+func (lc *LockClient) LockSubtree(name string) (int, Err) {
+	return lc.lock(LockArgs{Lock: name, Subtree: true})
+}
+
+// Locks name and every lock below it in shared mode.
+func (lc *LockClient) LockSubtreeShared(name string) (int, Err) {
+	return lc.lock(LockArgs{Lock: name, Shared: true, Subtree: true})
+}
+
+// Sends a Lock RPC for args as a new request.
+func (lc *LockClient) lock(args LockArgs) (int, Err) {
+	args.Seq, args.Acked = lc.begin()
+	defer lc.end(args.Seq)
+	return lc.sendLock(args)
+}
+
+// Sends a Lock RPC for args, filling in who I am.
+func (lc *LockClient) sendLock(args LockArgs) (int, Err) {
+	if err := lc.sessionErr(); err != "" {
+		return 0, err
+	}
+
+	lc.mu.Lock()
+	args.Client = lc.ClientId
+	args.Session = lc.session != noSession
+	lc.mu.Unlock()
+
 	var reply LockReply
 
-	ok := call(lc.server, "LockService.Lock", &args, &reply)
+	ok := lc.call("LockService.Lock", &args, &reply)
+
+	if !ok {
+		return 0, ConnectionFailure
+	}
+
+	return reply.Token, reply.Err
+}
+
+func (lc *LockClient) Unlock(name string) Err {
+	seq, acked := lc.begin()
+	defer lc.end(seq)
+	return lc.sendUnlock(name, seq, acked)
+}
+
+// Sends an Unlock RPC for name as request seq.
+func (lc *LockClient) sendUnlock(name string, seq int, acked int) Err {
+	if err := lc.sessionErr(); err != "" {
+		return err
+	}
+
+	args := UnlockArgs{lc.ClientId, name, seq, acked}
+	var reply UnlockReply
+
+	ok := lc.call("LockService.Unlock", &args, &reply)
 
 	if !ok {
 		return ConnectionFailure
@@ -29,11 +221,133 @@ func (lc *LockClient) Lock(lockId int) Err {
 	return reply.Err
 }
 
-func (lc *LockClient) Unlock(lockId int) Err {
-	args := UnlockArgs{lc.ClientId, lockId}
-	var reply UnlockReply
+func (lc *LockClient) Renew(name string) Err {
+	if err := lc.sessionErr(); err != "" {
+		return err
+	}
+
+	seq, acked := lc.begin()
+	defer lc.end(seq)
+	args := RenewArgs{lc.ClientId, name, seq, acked}
+	var reply RenewReply
+
+	ok := lc.call("LockService.Renew", &args, &reply)
+
+	if !ok {
+		return ConnectionFailure
+	}
+
+	return reply.Err
+}
+
+// Waits for the holders of name to change in an instance after after, and
+// returns the latest change. Pass -1 to get the latest change at once, if
+// name has ever been held, and the Instance of each returned Event to wait
+// for the next. An Event whose Previous isn't the instance passed in
+// means changes were missed in between.
+func (lc *LockClient) Watch(name string, after int) (Event, Err) {
+	args := WatchArgs{name, after}
+	for {
+		var reply WatchReply
+
+		ok := lc.call("LockService.Watch", &args, &reply)
+
+		if !ok {
+			return Event{}, ConnectionFailure
+		}
+		if reply.Err != Timeout {
+			return reply.Event, reply.Err
+		}
+	}
+}
+
+// Opens a session that lasts as long as the cluster hears a keepalive
+// within every timeout. Keepalives are sent in the background until the
+// session is closed or expires; if it expires, the cluster releases every
+// lock I hold and I get SessionExpired from then on.
+func (lc *LockClient) OpenSession(timeout time.Duration) Err {
+	err := lc.sessionCall("LockService.OpenSession", timeout)
+	if err != OK {
+		return err
+	}
+
+	lc.mu.Lock()
+	lc.session = sessionOpen
+	lc.timeout = timeout
+	lc.mu.Unlock()
+	lc.sched.Go(func() { lc.keepAlive(timeout) })
+	return OK
+}
+
+// Opens a new session with the timeout of my last, after it expired.
+func (lc *LockClient) reopenSession() Err {
+	lc.mu.Lock()
+	timeout := lc.timeout
+	lc.mu.Unlock()
+	return lc.OpenSession(timeout)
+}
+
+// Ends my session, releasing every lock I hold.
+func (lc *LockClient) CloseSession() Err {
+	lc.mu.Lock()
+	lc.session = sessionClosed
+	lc.mu.Unlock()
+	return lc.sessionCall("LockService.CloseSession", 0)
+}
+
+// Sends a KeepAlive three times per timeout while my session is open.
+func (lc *LockClient) keepAlive(timeout time.Duration) {
+	for {
+		lc.sched.Sleep(timeout / 3)
+
+		lc.mu.Lock()
+		open := lc.session == sessionOpen
+		lc.mu.Unlock()
+		if !open {
+			return
+		}
+
+		if lc.sessionCall("LockService.KeepAlive", 0) == SessionExpired {
+			lc.mu.Lock()
+			lc.session = sessionExpired
+			lc.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (lc *LockClient) sessionCall(rpcname string, timeout time.Duration) Err {
+	seq, acked := lc.begin()
+	defer lc.end(seq)
+	args := SessionArgs{lc.ClientId, timeout, seq, acked}
+	var reply SessionReply
+
+	ok := lc.call(rpcname, &args, &reply)
+
+	if !ok {
+		return ConnectionFailure
+	}
+
+	return reply.Err
+}
+
+// Asks the cluster to add peer as a member.
+func (lc *LockClient) AddPeer(peer string) Err {
+	return lc.membership("LockService.AddPeer", peer)
+}
+
+// Asks the cluster to remove peer.
+func (lc *LockClient) RemovePeer(peer string) Err {
+	return lc.membership("LockService.RemovePeer", peer)
+}
+
+func (lc *LockClient) membership(rpcname string, peer string) Err {
+	seq, acked := lc.begin()
+	defer lc.end(seq)
+	args := MembershipArgs{lc.ClientId, peer, seq, acked}
+	var reply MembershipReply
 
-	ok := call(lc.server, "LockService.Unlock", &args, &reply)
+	ok := lc.call(rpcname, &args, &reply)
 
 	if !ok {
 		return ConnectionFailure
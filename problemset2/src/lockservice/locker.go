@@ -0,0 +1,199 @@
+package lockservice
+
+//
+// A client API built on contexts, and locks usable as a sync.Locker.
+//
+// LockContext waits for a lock until it is granted or its context is
+// done. In that case it sends a Cancel naming the Lock request, which
+// takes the client out of line through the log, or keeps the Lock from
+// being applied if it hasn't been yet. If the lock was granted in the
+// meantime it is given back, so the client never ends up holding a lock
+// it gave up on. LockOptions ask for the same modes and leases as the
+// other Lock calls.
+//
+// A Locker has no way to report errors, so it retries until it succeeds:
+// after the cluster couldn't be reached, and after the client's session
+// expired, in a new session.
+//
+// The calls run as tasks of the client's Scheduler, and learn that their
+// context is done through its AfterDone rather than by waiting on
+// ctx.Done(), so they stay deterministic under a Simulation.
+//
+
+import "context"
+import "fmt"
+import "sync"
+import "time"
+
+// A call running as a task of the client's Scheduler.
+type clientTask struct {
+	mu       sync.Mutex
+	finished Cond
+	done     bool
+}
+
+// Runs f as a task.
+func (lc *LockClient) spawn(f func()) *clientTask {
+	t := &clientTask{}
+	t.finished = lc.sched.NewCond(&t.mu)
+	lc.sched.Go(func() {
+		f()
+		t.mu.Lock()
+		t.done = true
+		t.finished.Broadcast()
+		t.mu.Unlock()
+	})
+	return t
+}
+
+// Waits for t to finish.
+func (t *clientTask) wait() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for !t.done {
+		t.finished.Wait()
+	}
+}
+
+// Waits for t to finish or ctx to be done. Returns whether t finished.
+func (lc *LockClient) waitContext(ctx context.Context, t *clientTask) bool {
+	timer := lc.sched.AfterDone(ctx, func() {
+		t.mu.Lock()
+		t.finished.Broadcast()
+		t.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for !t.done && ctx.Err() == nil {
+		t.finished.Wait()
+	}
+	return t.done
+}
+
+// Returns Timeout if ctx passed its deadline, and Canceled otherwise.
+func contextErr(ctx context.Context) Err {
+	if ctx.Err() == context.DeadlineExceeded {
+		return Timeout
+	}
+	return Canceled
+}
+
+// How LockContext locks, as in LockArgs.
+type LockOptions struct {
+	Lease   time.Duration // Released unless renewed within this long, or 0 to hold until unlocked.
+	Try     bool          // Fail with Locked rather than wait if the lock is held.
+	Shared  bool          // Lock in shared mode.
+	Subtree bool          // Also lock everything below name in the hierarchy.
+}
+
+// Locks name as opts ask, waiting until it is granted or ctx is done. If
+// ctx is done first, returns Canceled, or Timeout if it passed its
+// deadline, once the client is out of line and doesn't hold the lock.
+func (lc *LockClient) LockContext(ctx context.Context, name string, opts LockOptions) (int, Err) {
+	if ctx.Err() != nil {
+		return 0, contextErr(ctx)
+	}
+
+	seq, acked := lc.begin()
+	args := LockArgs{Lock: name, Lease: opts.Lease, Try: opts.Try, Shared: opts.Shared, Subtree: opts.Subtree,
+		Seq: seq, Acked: acked}
+	var token int
+	var err Err
+	t := lc.spawn(func() { token, err = lc.sendLock(args) })
+	if lc.waitContext(ctx, t) {
+		lc.end(seq)
+		return token, err
+	}
+
+	// Gives the lock back if the cluster handed it to me.
+	release := func() {
+		t.wait()
+		lc.end(seq)
+		if err == OK {
+			lc.Unlock(name)
+		}
+	}
+	if lc.cancel(name, seq) != OK {
+		// The cluster may still hand me the lock.
+		lc.sched.Go(release)
+		return 0, contextErr(ctx)
+	}
+
+	// My Lock replies as soon as the Cancel is committed.
+	release()
+	return 0, contextErr(ctx)
+}
+
+// Unlocks name, unless ctx is done first, in which case returns Canceled
+// or Timeout. The Unlock may still be applied after that.
+func (lc *LockClient) UnlockContext(ctx context.Context, name string) Err {
+	if ctx.Err() != nil {
+		return contextErr(ctx)
+	}
+
+	var err Err
+	t := lc.spawn(func() { err = lc.Unlock(name) })
+	if lc.waitContext(ctx, t) {
+		return err
+	}
+	return contextErr(ctx)
+}
+
+// Takes me out of line for name, or keeps my Lock request target from
+// being applied if it hasn't been yet.
+func (lc *LockClient) cancel(name string, target int) Err {
+	seq, acked := lc.begin()
+	defer lc.end(seq)
+	args := CancelArgs{lc.ClientId, name, target, seq, acked}
+	var reply CancelReply
+
+	ok := lc.call("LockService.Cancel", &args, &reply)
+
+	if !ok {
+		return ConnectionFailure
+	}
+
+	return reply.Err
+}
+
+// A sync.Locker for one lock of the cluster.
+type locker struct {
+	lc   *LockClient
+	name string
+}
+
+// Returns a sync.Locker that locks and unlocks name, which must be a valid
+// lock name. Its methods retry until they succeed.
+func (lc *LockClient) Locker(name string) sync.Locker {
+	if !ValidLockName(name) {
+		panic(fmt.Sprintf("Locker %v: %v", name, BadLockName))
+	}
+	return &locker{lc, name}
+}
+
+// Locks name, retrying until it is granted.
+func (l *locker) Lock() {
+	for {
+		_, err := l.lc.Lock(l.name)
+		if err == OK {
+			return
+		}
+		if err == SessionExpired {
+			l.lc.reopenSession()
+		}
+		l.lc.sched.Sleep(retryInterval)
+	}
+}
+
+// Unlocks name, retrying the same request until the cluster answers. If the
+// cluster already took the lock away (its lease or my session expired),
+// there is nothing left to unlock.
+func (l *locker) Unlock() {
+	seq, acked := l.lc.begin()
+	defer l.lc.end(seq)
+	for l.lc.sendUnlock(l.name, seq, acked) == ConnectionFailure {
+		l.lc.sched.Sleep(retryInterval)
+	}
+}
@@ -0,0 +1,91 @@
+package lockservice
+
+import "context"
+import "testing"
+import "time"
+
+// A LockContext canceled while waiting returns Canceled and leaves the
+// line, so the next client in line gets the lock.
+func TestLockContextCancel(t *testing.T) {
+	sim, servers, services := makeSimCluster(12, 3)
+	a := sim.MakeLockClient(servers...)
+	b := sim.MakeLockClient(servers...)
+	c := sim.MakeLockClient(servers...)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var bErr, cErr Err
+	var bAt, cAt time.Duration
+	begin := sim.Now()
+	sim.Go(func() {
+		a.Lock("/a")
+		sim.Sleep(10 * time.Second)
+		a.Unlock("/a")
+	})
+	sim.Go(func() {
+		sim.Sleep(time.Second)
+		_, bErr = b.LockContext(ctx, "/a", LockOptions{})
+		bAt = sim.Now().Sub(begin)
+	})
+	sim.Go(func() {
+		sim.Sleep(2 * time.Second)
+		_, cErr = c.Lock("/a")
+		cAt = sim.Now().Sub(begin)
+	})
+	sim.Go(func() {
+		sim.Sleep(3 * time.Second)
+		cancel()
+	})
+	sim.Run(60 * time.Second)
+
+	if bErr != Canceled || bAt > 4*time.Second {
+		t.Fatalf("B: LockContext = %v after %v, want Canceled after 3s", bErr, bAt)
+	}
+	if cErr != OK || cAt < 10*time.Second || cAt > 11*time.Second {
+		t.Fatalf("C: Lock = %v after %v, want OK when A unlocks at 10s", cErr, cAt)
+	}
+	checkReplicasAgree(t, services)
+}
+
+// A LockContext canceled just as the lock is handed to it gives the lock
+// back, so that nobody is left holding it.
+func TestLockContextGivesBack(t *testing.T) {
+	gaveBack := 0
+	for seed := int64(0); seed < 20; seed++ {
+		sim, servers, services := makeSimCluster(seed, 3)
+		a := sim.MakeLockClient(servers...)
+		b := sim.MakeLockClient(servers...)
+		ctx, cancel := context.WithCancel(context.Background())
+
+		var bErr Err
+		sim.Go(func() {
+			a.Lock("/a")
+			sim.Sleep(5 * time.Second)
+			// B's Cancel races A's Unlock, which may hand B the lock first.
+			cancel()
+			a.Unlock("/a")
+		})
+		sim.Go(func() {
+			sim.Sleep(time.Second)
+			_, bErr = b.LockContext(ctx, "/a", LockOptions{})
+		})
+		sim.Run(60 * time.Second)
+
+		if bErr != Canceled {
+			t.Fatalf("seed %v: B: LockContext = %v, want Canceled", seed, bErr)
+		}
+		if held, locked := replicaState(services[0]).Locks["/a"]; locked {
+			t.Fatalf("seed %v: B gave up, but the lock is held by %v", seed, held)
+		}
+		for _, ops := range committedLog(services[0]) {
+			for _, op := range ops {
+				if op.OpType == Unlock && op.Client == b.ClientId {
+					gaveBack++
+				}
+			}
+		}
+		checkReplicasAgree(t, services)
+	}
+	if gaveBack == 0 {
+		t.Fatalf("B never got the lock to give back")
+	}
+}
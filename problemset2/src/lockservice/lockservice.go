@@ -1,10 +1,7 @@
 package lockservice
 
-import "encoding/gob"
 import "fmt"
-import "net"
-import "net/rpc"
-import "net/http"
+import "sync"
 import "time"
 
 const Debug = 1
@@ -17,183 +14,718 @@ func DPrintf(format string, a ...interface{}) (n int, err error) {
 }
 
 type LockService struct {
-	locks    map[int]int // map lock id -> client id (or Unlocked)
-	px       *Paxos
-	max      int // The highest instance committed locally.
-	requests chan Request
-	servers  []string
-	me       int
+	mu        sync.Mutex          // Protects everything below but px.
+	locks     map[string]int      // map lock name -> client id holding it exclusively, if any
+	readers   map[string][]int    // map lock name -> client ids holding it shared, in order of grant
+	tokens    map[Hold]int        // map holder -> fencing token of its grant
+	waiters   map[string][]Waiter // map lock name -> clients waiting for it, in order
+	position  int                 // The place in line of the latest client to get in line.
+	subtrees  map[Hold]bool       // holders that also hold everything below their lock
+	changes   map[string]Change   // map lock name -> last change to its holders
+	tables    map[int]ClientTable // map client id -> results of its requests
+	leases    map[Hold]Lease      // map holder -> its lease, if it has one
+	renewed   map[Hold]time.Time  // map holder -> when I committed its lease's start
+	sessions  map[int]Session     // map client id -> its open session
+	keptAlive map[int]time.Time   // map client id -> when I committed its session's last keepalive
+	token     int                 // The fencing token of the latest grant of any lock.
+	px        *TypedPaxos[[]Op]
+	max       int                // The highest instance committed locally.
+	requests  []*Request         // Requests waiting to be agreed on, oldest first.
+	proposed  map[int][]*Request // map instance -> my batch of requests proposed for it
+	changed   Cond               // Signalled when a request is queued or an instance committed.
+	config    Config             // The peers that agree on instances after max.
+	me        string
+	server    Server    // Receives RPCs for this LockService and its Paxos peer.
+	transport Transport // Carries RPCs to the other LockServices.
+	sched     Scheduler // Runs goroutines and timers.
+	dir       string    // Where snapshots are saved, or "" to keep them in memory.
+	snapshot  *Snapshot // The latest snapshot, or nil.
+	inUse     []string  // The names of the locks with holders or waiters, in order.
+	dead      bool      // Set by Kill(): every loop returns, and waiting requests fail.
 }
 
 type Request struct {
-	Op       Op
-	Response chan Err
+	Op    Op
+	Err   Err  // The result of the operation,
+	Token int  // and the fencing token of a successful Lock,
+	Done  bool // once the operation has been committed.
 }
 
-const Requeue = "Requeue" // Response in Request struct to block on a lock
+const Queued = "Queued" // Response in Request struct to block on a lock
 
 // Op Types
 const (
-	Lock   = "Lock"
-	Unlock = "Unlock"
+	Lock       = "Lock"
+	Unlock     = "Unlock"
+	AddPeer    = "AddPeer"
+	RemovePeer = "RemovePeer"
+	Noop       = "Noop"
+	Renew      = "Renew"
+	Expire     = "Expire"
+	Cancel     = "Cancel"
+
+	OpenSession   = "OpenSession"
+	KeepAlive     = "KeepAlive"
+	CloseSession  = "CloseSession"
+	ExpireSession = "ExpireSession"
 )
 
 type OpType string
 
 type Op struct {
-	OpType OpType
+	OpType   OpType
+	Client   int
+	Lock     string
+	Peer     string        // The peer added or removed by AddPeer and RemovePeer.
+	Lease    time.Duration // A Lock's lease (0 holds the lock until unlocked), or an OpenSession's timeout.
+	Instance int           // The start of the lease or session an Expire or ExpireSession ends.
+	Session  bool          // A Lock from a client whose session must be open.
+	Try      bool          // A Lock that fails rather than wait for the lock.
+	Shared   bool          // A Lock in shared mode.
+	Subtree  bool          // A Lock of everything below Lock too.
+	Target   int           // The client's Lock request a Cancel cancels, or 0.
+	Seq      int           // The client's number for the request, or 0 for ops not sent by a client.
+	Acked    int           // The client has had replies to every request up to Acked.
+}
+
+// A client waiting in line for a lock.
+type Waiter struct {
+	Client   int
+	Lease    time.Duration // The lease the client asked for.
+	Shared   bool          // Whether the client asked for shared mode,
+	Subtree  bool          // and for everything below the lock too.
+	Position int           // The client's place in line, counted across every lock.
+}
+
+// A client holding a lock.
+type Hold struct {
+	Lock   string
 	Client int
-	Lock   int
 }
 
 // Represents an unlocked lock.
 const Unlocked = -1
 
-// RPC Handler: Lock a given lock. Will not respond to client until the lock is
-// aquired.
+// How long an instance may stay undecided while later ones are known
+// before I propose a Noop to fill the gap.
+const gapTimeout = 1 * time.Second
+
+// How often I look for such gaps.
+const gapCheckInterval = 100 * time.Millisecond
+
+// How long a client's request waits for its operation to be committed
+// before I reply Unavailable, so that the client of a replica cut off from
+// the majority tries another one. The operation stays in line to be
+// proposed, and a retry of it anywhere gets its result.
+const agreementTimeout = 2 * time.Second
+
+// RPC Handler: Lock a given lock, named by a path such as
+// /billing/invoices/42. Will not respond to client until the lock is
+// aquired. A client that finds the lock held waits in line for it, and is
+// handed the lock by the Unlock of the client ahead of it. The reply
+// carries the fencing token of the grant.
+// With args.Shared, the lock is taken in shared mode, and is held by any
+// number of clients in shared mode at once. A client asking for shared
+// mode still waits behind any client already waiting, so a stream of
+// shared holders can't starve a client waiting for exclusive mode.
+// With args.Subtree, the client also holds every lock below the lock in
+// the hierarchy, and waits for any client holding one of them.
+// With args.Try, replies Locked at once if the lock is held. With
+// args.Timeout, gives up waiting that long after I got the request and
+// replies Timeout.
 func (ls *LockService) Lock(args *LockArgs, reply *LockReply) error {
-	op := Op{Lock, args.Client, args.Lock}
+	if !ValidLockName(args.Lock) {
+		reply.Err = BadLockName
+		return nil
+	}
+	var deadline time.Time
+	if args.Timeout > 0 {
+		deadline = ls.sched.Now().Add(args.Timeout)
+	}
+	op := Op{OpType: Lock, Client: args.Client, Lock: args.Lock, Lease: args.Lease,
+		Session: args.Session, Try: args.Try, Shared: args.Shared, Subtree: args.Subtree,
+		Seq: args.Seq, Acked: args.Acked}
+	reply.Err, reply.Token = ls.submitRequest(op, agreementTimeout)
+	if reply.Err == Queued {
+		reply.Err, reply.Token = ls.waitForLock(args.Lock, args.Client, args.Session, deadline)
+	}
+	return nil
+}
 
-	to := 10 * time.Millisecond
-	for {
-		err := ls.enqueueRequest(op)
-		if err == Requeue {
-			time.Sleep(to)
-			if to < 1*time.Second {
-				to *= 2
+// Waits until the applier has committed the handoff of lock to client, and
+// returns the fencing token of the handoff. Returns Expired if the client
+// was handed the lock but its lease ended before I noticed, or if it was
+// taken out of line by a Cancel, and SessionExpired if it asked with a
+// session that has since ended. If deadline is not zero and passes first,
+// takes the client out of line and returns Timeout, or Unavailable if
+// that can't be committed within agreementTimeout.
+func (ls *LockService) waitForLock(lock string, client int, session bool, deadline time.Time) (Err, int) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	timedOut := false
+	if !deadline.IsZero() {
+		timer := ls.sched.AfterFunc(deadline.Sub(ls.sched.Now()), func() {
+			ls.mu.Lock()
+			timedOut = true
+			ls.changed.Broadcast()
+			ls.mu.Unlock()
+		})
+		defer timer.Stop()
+	}
+
+	for !ls.holds(lock, client) {
+		if ls.dead {
+			return ConnectionFailure, 0
+		}
+		if !isWaiting(ls.waiters[lock], client) {
+			if _, open := ls.sessions[client]; session && !open {
+				return SessionExpired, 0
 			}
-		} else {
-			reply.Err = err
-			return nil
+			return Expired, 0
 		}
+		if timedOut {
+			return ls.cancelWait(lock, client)
+		}
+		ls.changed.Wait()
+	}
+	return OK, ls.tokens[Hold{lock, client}]
+}
+
+// Takes client out of line for lock through the log. The lock may have
+// been handed to the client before that was committed, in which case it
+// keeps it.
+// Precondition: ls.mu is locked.
+func (ls *LockService) cancelWait(lock string, client int) (Err, int) {
+	ls.mu.Unlock()
+	err := ls.enqueueRequest(Op{OpType: Cancel, Client: client, Lock: lock})
+	ls.mu.Lock()
+	if ls.holds(lock, client) {
+		return OK, ls.tokens[Hold{lock, client}]
+	}
+	if err == Unavailable {
+		// The client may still be in line. It asks another replica.
+		return Unavailable, 0
 	}
+	return Timeout, 0
 }
 
 // RPC Handler: Unlock a given lock. Will return an error if the lock was
 // already unlocked or if the lock is locked by another client.
 func (ls *LockService) Unlock(args *UnlockArgs, reply *UnlockReply) error {
-	op := Op{Unlock, args.Client, args.Lock}
+	if !ValidLockName(args.Lock) {
+		reply.Err = BadLockName
+		return nil
+	}
+	op := Op{OpType: Unlock, Client: args.Client, Lock: args.Lock, Seq: args.Seq, Acked: args.Acked}
+	reply.Err = ls.enqueueRequest(op)
+	return nil
+}
+
+// RPC Handler: Take the client out of line for a lock it is waiting for.
+// Its pending Lock then replies Expired, or Canceled if the Lock request
+// args.Target hadn't been applied yet. If the lock was handed to the
+// client first, it keeps it and must unlock it.
+func (ls *LockService) Cancel(args *CancelArgs, reply *CancelReply) error {
+	if !ValidLockName(args.Lock) {
+		reply.Err = BadLockName
+		return nil
+	}
+	op := Op{OpType: Cancel, Client: args.Client, Lock: args.Lock, Target: args.Target,
+		Seq: args.Seq, Acked: args.Acked}
 	reply.Err = ls.enqueueRequest(op)
 	return nil
 }
 
 // Adds the provided operation to the queue of lock operations to perform.
-// Returns the response once the opeation has completed.
+// Returns the response once the opeation has completed, or Unavailable if
+// it isn't committed within agreementTimeout.
 func (ls *LockService) enqueueRequest(op Op) Err {
-	response := make(chan Err)
-	request := Request{op, response}
-	ls.requests <- request
-	return <-response
+	err, _ := ls.submitRequest(op, agreementTimeout)
+	return err
+}
+
+// Adds the provided operation to the queue of lock operations to perform.
+// Returns the response and fencing token once the operation has completed,
+// or Unavailable if it isn't committed within timeout. A timeout of 0
+// waits for ever.
+func (ls *LockService) submitRequest(op Op, timeout time.Duration) (Err, int) {
+	request := &Request{Op: op}
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.requests = append(ls.requests, request)
+	ls.changed.Broadcast()
+
+	timedOut := false
+	if timeout > 0 {
+		timer := ls.sched.AfterFunc(timeout, func() {
+			ls.mu.Lock()
+			timedOut = true
+			ls.changed.Broadcast()
+			ls.mu.Unlock()
+		})
+		defer timer.Stop()
+	}
+
+	for !request.Done {
+		if ls.dead {
+			return ConnectionFailure, 0
+		}
+		if timedOut {
+			return Unavailable, 0
+		}
+		ls.changed.Wait()
+	}
+	return request.Err, request.Token
 }
 
-// Takes lock operations from the queue and attempts to have them added to the
-// operation log. Adds the results of the operation request to the channel
-// monitored by the thread handling this RPC request.
+// Takes lock operations from the queue, as many as fit in a batch, and
+// attempts to have them added to the operation log. The applier completes
+// each request once its operation has been committed.
 func (ls *LockService) dequeueRequests() {
 	for {
-		request := <-ls.requests
-		err := ls.getAgreement(request.Op)
-		request.Response <- err
+		ls.mu.Lock()
+		for len(ls.requests) == 0 && !ls.dead {
+			ls.changed.Wait()
+		}
+		if ls.dead {
+			ls.mu.Unlock()
+			return
+		}
+		n := len(ls.requests)
+		if n > maxBatch {
+			n = maxBatch
+		}
+		batch := ls.requests[:n:n]
+		ls.requests = ls.requests[n:]
+		ls.mu.Unlock()
+
+		ls.getAgreement(batch)
 	}
 }
 
-// Gets Paxos to agree to the given operation. If other nodes have already
-// agreed on operations that have not yet been committed, then those are
-// committed before the given operation.
-// Precondition: ls.mu is locked.
-// Returns the Err string, and the previous value if it was a Put operation
-// on a key that already existed, or the value for the key if it was a Get
-// operation.
-func (ls *LockService) getAgreement(myOp Op) Err {
+// Gets Paxos to agree to the operations of batch, proposing them together
+// for the next instance to commit until they are the ones decided there.
+// Returns once every request in batch is done.
+func (ls *LockService) getAgreement(batch []*Request) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	ops := requestOps(batch)
+
 	// Keep trying to propose a paxos instance until it succeeds.
+	for !batch[0].Done && !ls.dead {
+		if !ls.config.Contains(ls.me) {
+			// I've been removed from the cluster, and can't propose.
+			for _, request := range batch {
+				request.Err = NotMember
+				request.Done = true
+			}
+			ls.changed.Broadcast()
+			return
+		}
+
+		instance := ls.max + 1
+		ls.proposed[instance] = batch
+		ls.mu.Unlock()
+		ls.px.Start(instance, ops)
+		ls.mu.Lock()
+
+		// Wait for the applier to commit the instance, whatever was decided.
+		for ls.max < instance && !ls.dead {
+			ls.changed.Wait()
+		}
+		delete(ls.proposed, instance)
+	}
+}
+
+// Commits decided instances to the local state in order, as soon as each
+// is decided, whether or not this LockService proposed them, so that it
+// stays current while its own clients are idle. Stops for good at a batch
+// of a later version than mine.
+func (ls *LockService) applyDecided() {
 	for {
 		instance := ls.max + 1
-		ls.px.Start(instance, myOp)
-
-		to := 10 * time.Millisecond
-		// Check the Paxos status until it is decided.
-		decided, value := ls.px.Status(instance)
-		for !decided {
-			time.Sleep(to)
-			if to < 10*time.Second {
-				to *= 2
-			}
-			decided, value = ls.px.Status(instance)
+		decided, ops, err := ls.px.Wait(instance)
+		if ls.killed() {
+			return
 		}
-		op := value.(Op)
+		if !decided {
+			// The other peers moved on without me.
+			ls.catchUp()
+			continue
+		}
+
+		ops, err = decodedOps(ops, err)
+		if err != nil {
+			fmt.Printf("LockService %v: stopped before instance %v, which needs a later release: %v\n",
+				ls.me, instance, err)
+			return
+		}
+
+		ls.mu.Lock()
+		ls.commitOperation(instance, ops)
+		ls.mu.Unlock()
+	}
+}
 
-		// Operation needs to be done regardless of whether our operation was
-		// chosen.
-		err := ls.commitOperation(instance, op)
+// Proposes a Noop for the next instance to commit if it stays undecided
+// for gapTimeout while later ones are known, since nobody else may ever
+// finish it.
+func (ls *LockService) fillGaps() {
+	gapSince := ls.sched.Now() // When I last knew of no later instance.
+	filled := -1               // The last instance I proposed a Noop for.
+	for {
+		ls.sched.Sleep(gapCheckInterval)
+
+		ls.mu.Lock()
+		instance := ls.max + 1
+		dead := ls.dead
+		ls.mu.Unlock()
 
-		// Finish when myOp was the one committed.
-		if op == myOp {
-			return err
+		if dead {
+			return
+		}
+
+		if ls.px.Max() <= instance {
+			gapSince = ls.sched.Now()
+		} else if ls.sched.Now().Sub(gapSince) > gapTimeout && filled < instance && ls.isMember() {
+			ls.px.Start(instance, []Op{{OpType: Noop}})
+			filled = instance
 		}
 	}
-	// Should never reach here
-	panic("ls.getAgreement(): Unreachable code!")
 }
 
-// Applies the given operation to the local state at this LockService.
-func (ls *LockService) commitOperation(instance int, op Op) Err {
+// Returns whether I'm a member of the cluster.
+func (ls *LockService) isMember() bool {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return ls.config.Contains(ls.me)
+}
+
+// Applies the given batch of operations in order to the local state at this
+// LockService, and completes the requests I proposed for the instance if
+// they were the ones decided.
+// Precondition: ls.mu is locked.
+func (ls *LockService) commitOperation(instance int, ops []Op) {
 	if instance != ls.max+1 {
 		panic(fmt.Sprintf("Committing out of order! Expected: %v, Actual: %v\n", ls.max+1, instance))
 	}
 
 	ls.max++
 
-	fmt.Printf("commitOperation(instance: %v, Op{optype: %v, client: %v, lock%v})\n", instance, op.OpType, op.Client, op.Lock)
+	results := make([]Result, len(ops))
+	for i, op := range ops {
+		if op.OpType == Noop {
+			fmt.Printf("commitOperation(instance: %v, Op{optype: %v})\n", instance, op.OpType)
+		} else if op.OpType == AddPeer || op.OpType == RemovePeer {
+			fmt.Printf("commitOperation(instance: %v, Op{optype: %v, peer: %v})\n", instance, op.OpType, op.Peer)
+		} else {
+			fmt.Printf("commitOperation(instance: %v, Op{optype: %v, client: %v, lock: %v})\n", instance, op.OpType, op.Client, op.Lock)
+		}
+
+		results[i] = ls.applyOnce(op)
+	}
 
-	// Initialize lock if it doesn't exist
-	if _, exists := ls.locks[op.Lock]; !exists {
-		ls.locks[op.Lock] = Unlocked
+	if ls.max%SnapshotInterval == SnapshotInterval-1 {
+		// Prune at the same instances on every replica, so their states
+		// stay the same.
+		ls.pruneTables()
+		ls.pruneChanges()
+		ls.takeSnapshot()
+	}
+
+	if batch, ok := ls.proposed[instance]; ok && sameOps(requestOps(batch), ops) {
+		for i, request := range batch {
+			request.Err = results[i].Err
+			request.Token = results[i].Token
+			request.Done = true
+		}
+	}
+	ls.changed.Broadcast()
+}
+
+// Applies the effect of op to the lock table, or to the membership.
+// Precondition: ls.mu is locked.
+func (ls *LockService) applyOperation(op Op) Err {
+	if op.OpType == Noop {
+		return OK
+	}
+	if op.OpType == AddPeer || op.OpType == RemovePeer {
+		return ls.applyMembership(op)
+	}
+	if op.OpType == Renew || op.OpType == Expire {
+		return ls.applyLease(op)
+	}
+	if op.OpType == Cancel {
+		ls.withdraw(op.Lock, op.Client)
+		return OK
+	}
+	if op.OpType == OpenSession || op.OpType == KeepAlive || op.OpType == CloseSession || op.OpType == ExpireSession {
+		return ls.applySession(op)
 	}
 
 	if op.OpType == Lock {
-		if ls.locks[op.Lock] != Unlocked {
-			return Requeue
+		if _, open := ls.sessions[op.Client]; op.Session && !open {
+			return SessionExpired
+		}
+
+		if ls.holds(op.Lock, op.Client) {
+			if contains(ls.readers[op.Lock], op.Client) != op.Shared {
+				// Changing modes would deadlock with the other holders.
+				return Locked
+			}
+			// A retry of a Lock that already succeeded.
+			return OK
+		}
+
+		// Shared mode is granted alongside other shared holders, but
+		// never ahead of a client already waiting.
+		waiter := Waiter{op.Client, op.Lease, op.Shared, op.Subtree, ls.position + 1}
+		if len(ls.waiters[op.Lock]) > 0 || ls.blocked(op.Lock, waiter) {
+			if op.Try {
+				return Locked
+			}
+			if !isWaiting(ls.waiters[op.Lock], op.Client) {
+				ls.position++
+				ls.waiters[op.Lock] = append(ls.waiters[op.Lock], waiter)
+				ls.track(op.Lock)
+			}
+			return Queued
 		}
 
-		ls.locks[op.Lock] = op.Client
+		ls.grant(op.Lock, waiter)
 
 	} else if op.OpType == Unlock {
-		if ls.locks[op.Lock] == Unlocked {
+		if _, held := ls.locks[op.Lock]; !held && len(ls.readers[op.Lock]) == 0 {
 			return NotLocked
 		}
 
-		if ls.locks[op.Lock] != op.Client {
+		if !ls.holds(op.Lock, op.Client) {
 			return NotYourLock
 		}
 
-		ls.locks[op.Lock] = Unlocked
+		ls.release(op.Lock, op.Client)
 	}
 
 	return OK
 }
 
-func MakeLockService(servers []string, me int) *LockService {
-	gob.Register(Op{})
+// Returns whether client holds lock, in either mode.
+// Precondition: ls.mu is locked.
+func (ls *LockService) holds(lock string, client int) bool {
+	owner, exists := ls.locks[lock]
+	return (exists && owner == client) || contains(ls.readers[lock], client)
+}
+
+// Gives lock to the client of w in the mode it asked for, with a lease
+// starting at the current instance. The current instance is also the
+// fencing token of the grant, unless an earlier op of its batch already
+// took that token, in which case it gets the next one: either way it is
+// higher than that of every earlier grant of any lock.
+// Precondition: ls.mu is locked.
+func (ls *LockService) grant(lock string, w Waiter) {
+	if w.Shared {
+		ls.readers[lock] = append(ls.readers[lock], w.Client)
+	} else {
+		ls.locks[lock] = w.Client
+	}
+	if w.Subtree {
+		ls.subtrees[Hold{lock, w.Client}] = true
+	}
+	ls.token++
+	if ls.token < ls.max {
+		ls.token = ls.max
+	}
+	ls.tokens[Hold{lock, w.Client}] = ls.token
+	ls.track(lock)
+	ls.noteChange(lock)
+	if w.Lease > 0 {
+		ls.leases[Hold{lock, w.Client}] = Lease{w.Lease, ls.max}
+		ls.renewed[Hold{lock, w.Client}] = ls.sched.Now()
+	}
+}
+
+// Takes lock from client, and hands it on to the clients waiting for it.
+// Precondition: ls.mu is locked.
+func (ls *LockService) release(lock string, client int) {
+	if owner, held := ls.locks[lock]; held && owner == client {
+		delete(ls.locks, lock)
+	} else {
+		ls.readers[lock] = remove(ls.readers[lock], client)
+		if len(ls.readers[lock]) == 0 {
+			delete(ls.readers, lock)
+		}
+	}
+	delete(ls.subtrees, Hold{lock, client})
+	ls.track(lock)
+	ls.noteChange(lock)
+	delete(ls.tokens, Hold{lock, client})
+	delete(ls.leases, Hold{lock, client})
+	delete(ls.renewed, Hold{lock, client})
+
+	ls.handOffAround(lock)
+}
+
+// Grants lock to the clients at the front of its line that can hold it
+// now: one client in exclusive mode once nobody holds the lock, or every
+// client in shared mode up to the next one waiting for exclusive mode.
+// Precondition: ls.mu is locked.
+func (ls *LockService) handOff(lock string) {
+	for len(ls.waiters[lock]) > 0 {
+		next := ls.waiters[lock][0]
+		if ls.blocked(lock, next) {
+			break
+		}
+		ls.grant(lock, next)
+		ls.waiters[lock] = ls.waiters[lock][1:]
+	}
+	if len(ls.waiters[lock]) == 0 {
+		delete(ls.waiters, lock)
+	}
+	ls.track(lock)
+}
 
+// Returns whether client is in clients.
+func contains(clients []int, client int) bool {
+	for _, c := range clients {
+		if c == client {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns clients without client.
+func remove(clients []int, client int) []int {
+	var remaining []int
+	for _, c := range clients {
+		if c != client {
+			remaining = append(remaining, c)
+		}
+	}
+	return remaining
+}
+
+// Takes client out of the line for lock, if it is in it.
+// Precondition: ls.mu is locked.
+func (ls *LockService) withdraw(lock string, client int) {
+	var remaining []Waiter
+	for _, w := range ls.waiters[lock] {
+		if w.Client != client {
+			remaining = append(remaining, w)
+		}
+	}
+	if len(remaining) == 0 {
+		delete(ls.waiters, lock)
+	} else {
+		ls.waiters[lock] = remaining
+	}
+	ls.track(lock)
+
+	// The client may have been holding up the clients behind it.
+	ls.handOffAround(lock)
+}
+
+// Returns whether client is in waiters.
+func isWaiting(waiters []Waiter, client int) bool {
+	for _, w := range waiters {
+		if w.Client == client {
+			return true
+		}
+	}
+	return false
+}
+
+// Creates the LockService for servers[me] and starts serving its RPCs with
+// tr. servers is the initial membership of the cluster; a LockService that
+// saved a snapshot in dir uses the membership recorded there instead.
+// Durable Paxos state is kept in dir. Goroutines and timers are run by
+// sched.
+func MakeLockService(servers []string, me int, dir string, tr Transport, sched Scheduler) *LockService {
+	ids := make(map[string]int)
+	for i, server := range servers {
+		ids[server] = i
+	}
+	ls := makeLockService(servers[me], Config{0, servers, ids}, dir, tr, sched)
+	ls.start()
+	sched.Go(ls.dequeueRequests)
+	sched.Go(ls.applyDecided)
+	sched.Go(ls.fillGaps)
+	sched.Go(ls.expire)
+	return ls
+}
+
+// Creates a LockService with the state saved in dir, or an empty state
+// using config, without serving it yet.
+func makeLockService(me string, config Config, dir string, tr Transport, sched Scheduler) *LockService {
 	ls := new(LockService)
 	ls.me = me
-	ls.servers = servers
 	ls.max = -1
-	ls.locks = make(map[int]int)
-	ls.requests = make(chan Request, 256)
-
-	go ls.dequeueRequests()
-
-	rpc.Register(ls)
-	ls.px = MakePaxos(servers, me)
-	rpc.HandleHTTP()
-	listener, err := net.Listen("tcp", servers[me])
+	ls.token = -1
+	ls.locks = make(map[string]int)
+	ls.tokens = make(map[Hold]int)
+	ls.readers = make(map[string][]int)
+	ls.waiters = make(map[string][]Waiter)
+	ls.subtrees = make(map[Hold]bool)
+	ls.changes = make(map[string]Change)
+	ls.tables = make(map[int]ClientTable)
+	ls.leases = make(map[Hold]Lease)
+	ls.renewed = make(map[Hold]time.Time)
+	ls.sessions = make(map[int]Session)
+	ls.keptAlive = make(map[int]time.Time)
+	ls.proposed = make(map[int][]*Request)
+	ls.config = config
+	ls.transport = tr
+	ls.sched = sched
+	ls.changed = sched.NewCond(&ls.mu)
+	ls.dir = dir
+	ls.snapshot = ls.makeSnapshot()
+
+	if dir != "" {
+		snapshot, err := readSnapshot(dir)
+		if err != nil {
+			panic(err)
+		}
+		if snapshot != nil {
+			ls.mu.Lock()
+			ls.installSnapshot(snapshot)
+			ls.mu.Unlock()
+		}
+	}
+	return ls
+}
 
+// Starts the Paxos peer and serves RPCs.
+func (ls *LockService) start() {
+	server, err := ls.transport.Serve(ls.me)
 	if err != nil {
 		panic(err)
 	}
+	ls.server = server
+
+	ls.px = MakeTypedPaxos[[]Op](MakePaxos(ls.config, ls.me, ls.dir, ls.transport, server, ls.sched), opsCodec)
+	if err := server.Register(ls); err != nil {
+		panic(err)
+	}
+}
 
-	http.Serve(listener, nil)
+// Stops serving RPCs and every background loop, so this LockService looks
+// dead to its peers and clients, and proposes nothing more.
+func (ls *LockService) Kill() {
+	ls.mu.Lock()
+	ls.dead = true
+	ls.changed.Broadcast()
+	ls.mu.Unlock()
 
-	return ls
+	ls.px.Kill()
+	ls.server.Close()
+}
+
+// Returns whether Kill() has been called.
+func (ls *LockService) killed() bool {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return ls.dead
 }
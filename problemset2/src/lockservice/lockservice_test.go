@@ -0,0 +1,160 @@
+package lockservice
+
+import "fmt"
+import "reflect"
+import "sync"
+import "testing"
+import "time"
+
+// Clients waiting for a lock get it in the order they asked for it.
+func TestWaitersInOrder(t *testing.T) {
+	sim, servers, services := makeSimCluster(9, 3)
+
+	var granted []string
+	for i, name := range []string{"A", "B", "C"} {
+		lc := sim.MakeLockClient(servers...)
+		after := time.Duration(i) * time.Second
+		name := name
+		sim.Go(func() {
+			sim.Sleep(after)
+			if _, err := lc.Lock("/a"); err != OK {
+				t.Errorf("%v: Lock = %v", name, err)
+				return
+			}
+			granted = append(granted, name)
+			sim.Sleep(5 * time.Second)
+			if err := lc.Unlock("/a"); err != OK {
+				t.Errorf("%v: Unlock = %v", name, err)
+			}
+		})
+	}
+	sim.Run(60 * time.Second)
+
+	if want := []string{"A", "B", "C"}; !reflect.DeepEqual(granted, want) {
+		t.Fatalf("granted %v, want %v", granted, want)
+	}
+	checkReplicasAgree(t, services)
+}
+
+// Shared holders that waited behind an exclusive one get the lock together.
+func TestSharedHandOff(t *testing.T) {
+	sim, servers, services := makeSimCluster(3, 3)
+	clients := make(map[string]*LockClient)
+	for _, name := range []string{"A", "B", "C", "D"} {
+		clients[name] = sim.MakeLockClient(servers...)
+	}
+
+	begin := sim.Now()
+	granted := make(map[string]time.Duration)
+	lock := func(name string, shared bool, after time.Duration, hold time.Duration) {
+		sim.Go(func() {
+			sim.Sleep(after)
+			lc := clients[name]
+			lk := lc.Lock
+			if shared {
+				lk = lc.LockShared
+			}
+			if _, err := lk("/a"); err != OK {
+				t.Errorf("%v: Lock = %v", name, err)
+				return
+			}
+			granted[name] = sim.Now().Sub(begin).Round(time.Second)
+			sim.Sleep(hold)
+			if err := lc.Unlock("/a"); err != OK {
+				t.Errorf("%v: Unlock = %v", name, err)
+			}
+		})
+	}
+	lock("A", false, 0, 10*time.Second)
+	lock("B", false, 1*time.Second, 10*time.Second)
+	lock("C", true, 2*time.Second, 10*time.Second)
+	lock("D", true, 3*time.Second, 10*time.Second)
+	sim.Run(60 * time.Second)
+
+	// B waits for A, and the shared holders C and D for B, together.
+	want := map[string]time.Duration{"A": 0, "B": 10 * time.Second, "C": 20 * time.Second, "D": 20 * time.Second}
+	if !reflect.DeepEqual(granted, want) {
+		t.Fatalf("granted %v, want %v", granted, want)
+	}
+	checkReplicasAgree(t, services)
+}
+
+// A cluster on real goroutines and timers, where the race detector can see
+// what the simulation, running one task at a time, can't.
+func TestRealCluster(t *testing.T) {
+	tr := MakeMemoryTransport()
+	servers := []string{"real0", "real1", "real2"}
+	var services []*LockService
+	for i := range servers {
+		services = append(services, MakeLockService(servers, i, "", tr, MakeRealScheduler()))
+	}
+	defer func() {
+		for _, ls := range services {
+			ls.Kill()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for c := 0; c < 3; c++ {
+		lc := MakeLockClient(servers[c:], tr)
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				lock := fmt.Sprintf("/r/%v", i%3)
+				if _, err := lc.Lock(lock); err != OK {
+					errs <- fmt.Errorf("client %v: Lock(%v) = %v", c, lock, err)
+					return
+				}
+				if err := lc.Unlock(lock); err != OK {
+					errs <- fmt.Errorf("client %v: Unlock(%v) = %v", c, lock, err)
+					return
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// A client that times out waiting for a lock is told so after its timeout,
+// and is no longer in line for the lock.
+func TestLockTimeout(t *testing.T) {
+	sim, servers, services := makeSimCluster(8, 3)
+	a := sim.MakeLockClient(servers...)
+	b := sim.MakeLockClient(servers...)
+	c := sim.MakeLockClient(servers...)
+
+	var bErr, cErr Err
+	var waited time.Duration
+	sim.Go(func() {
+		if _, err := a.Lock("/a"); err != OK {
+			t.Errorf("A: Lock = %v", err)
+		}
+		sim.Sleep(10 * time.Second)
+		a.Unlock("/a")
+	})
+	sim.Go(func() {
+		sim.Sleep(time.Second)
+		start := sim.Now()
+		_, bErr = b.LockTimeout("/a", 3*time.Second)
+		waited = sim.Now().Sub(start)
+	})
+	sim.Go(func() {
+		sim.Sleep(2 * time.Second)
+		_, cErr = c.Lock("/a")
+	})
+	sim.Run(60 * time.Second)
+
+	if bErr != Timeout || waited < 3*time.Second || waited > 4*time.Second {
+		t.Fatalf("B: LockTimeout = %v after %v, want Timeout after 3s", bErr, waited)
+	}
+	if cErr != OK {
+		t.Fatalf("C: Lock = %v after B timed out ahead of it", cErr)
+	}
+	checkReplicasAgree(t, services)
+}
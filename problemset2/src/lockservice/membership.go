@@ -0,0 +1,113 @@
+package lockservice
+
+//
+// Changes to the membership of a LockService cluster.
+//
+// Adding or removing a peer is an Op like any other: it is agreed on in a
+// Paxos instance, and every LockService applies it when it commits that
+// instance. The new Config takes effect from the next instance, so every
+// peer that proposes an instance has already committed (and handed to
+// Paxos) the Config that decides it.
+//
+// A new server joins by asking a member to add it, then fetching the
+// member's state with a Transfer before it starts serving.
+//
+
+import "time"
+
+// RPC Handler: Add a peer to the cluster. Replies once the change has
+// been committed.
+func (ls *LockService) AddPeer(args *MembershipArgs, reply *MembershipReply) error {
+	reply.Err = ls.enqueueRequest(Op{OpType: AddPeer, Client: args.Client, Peer: args.Peer, Seq: args.Seq, Acked: args.Acked})
+	return nil
+}
+
+// RPC Handler: Remove a peer from the cluster. Replies once the change has
+// been committed.
+func (ls *LockService) RemovePeer(args *MembershipArgs, reply *MembershipReply) error {
+	reply.Err = ls.enqueueRequest(Op{OpType: RemovePeer, Client: args.Client, Peer: args.Peer, Seq: args.Seq, Acked: args.Acked})
+	return nil
+}
+
+// Applies an AddPeer or RemovePeer op committed in instance ls.max. The new
+// Config starts at the next instance.
+// Precondition: ls.mu is locked.
+func (ls *LockService) applyMembership(op Op) Err {
+	config := Config{ls.max + 1, nil, make(map[string]int)}
+	for peer, id := range ls.config.Ids {
+		config.Ids[peer] = id
+	}
+
+	if op.OpType == AddPeer {
+		if ls.config.Contains(op.Peer) {
+			return AlreadyMember
+		}
+		config.Peers = append(append(config.Peers, ls.config.Peers...), op.Peer)
+		if _, known := config.Ids[op.Peer]; !known {
+			// Ids are never reused, so ballots stay unique.
+			config.Ids[op.Peer] = len(config.Ids)
+		}
+	} else {
+		if !ls.config.Contains(op.Peer) {
+			return NotMember
+		}
+		if len(ls.config.Peers) == 1 {
+			return LastMember
+		}
+		for _, peer := range ls.config.Peers {
+			if peer != op.Peer {
+				config.Peers = append(config.Peers, peer)
+			}
+		}
+	}
+
+	ls.config = config
+	ls.px.Reconfigure(config)
+	return OK
+}
+
+// Creates a LockService for me that joins the cluster member belongs to,
+// and starts serving its RPCs with tr. Durable state is kept in dir; a
+// LockService that joined before can be restarted the same way.
+// Goroutines and timers are run by sched.
+func JoinLockService(member string, me string, dir string, tr Transport, sched Scheduler) *LockService {
+	ls := makeLockService(me, Config{}, dir, tr, sched)
+	reply := ls.join(member)
+	if len(ls.config.Peers) == 0 {
+		// I have no state of my own: start from the member's.
+		ls.mu.Lock()
+		ls.installSnapshot(reply.Snapshot)
+		ls.mu.Unlock()
+	}
+	ls.start()
+	ls.applyTransfer(reply)
+	sched.Go(ls.dequeueRequests)
+	sched.Go(ls.applyDecided)
+	sched.Go(ls.fillGaps)
+	sched.Go(ls.expire)
+	return ls
+}
+
+// Asks member to add me to the cluster, then fetches its state. Retries
+// until both succeed.
+func (ls *LockService) join(member string) *TransferReply {
+	for {
+		args := MembershipArgs{Peer: ls.me}
+		var reply MembershipReply
+		ok := ls.transport.Call(member, "LockService.AddPeer", &args, &reply)
+		if ok && (reply.Err == OK || reply.Err == AlreadyMember) {
+			break
+		}
+		DPrintf("join(): %v could not add me\n", member)
+		ls.sched.Sleep(100 * time.Millisecond)
+	}
+
+	for {
+		reply, ok := ls.fetchTransfer(member)
+		if ok {
+			return reply
+		}
+		DPrintf("join(): %v could not send its state\n", member)
+		ls.sched.Sleep(100 * time.Millisecond)
+	}
+}
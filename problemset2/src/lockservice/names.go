@@ -0,0 +1,157 @@
+package lockservice
+
+//
+// Lock names and the hierarchy they form.
+//
+// Locks are named by slash-separated paths such as /billing/invoices/42.
+// A lock is below every lock whose name is a prefix of its own path, so
+// /billing/invoices/42 is below /billing/invoices, /billing and /. A
+// client can lock a whole subtree at once: a Lock with Subtree set also
+// holds every lock below the named one, so it conflicts with any client
+// holding or waiting for one of them in a conflicting mode, and the
+// other way around. A plain Lock holds only the named lock.
+//
+// Only locks with holders or waiters are kept in the lock table, and
+// their names are indexed in order, so finding the locks that may
+// conflict with one takes a lookup for each lock above it and a range of
+// the index for the locks below it, however many names have been used.
+//
+
+import "path"
+import "sort"
+import "strings"
+
+// Returns whether name is a valid lock name: a clean, absolute path.
+func ValidLockName(name string) bool {
+	return strings.HasPrefix(name, "/") && path.Clean(name) == name
+}
+
+// Returns whether lock is below parent in the hierarchy.
+func isBelow(lock string, parent string) bool {
+	if parent == "/" {
+		return lock != "/"
+	}
+	return strings.HasPrefix(lock, parent+"/")
+}
+
+// Returns whether holding a (and everything below it, with aSubtree)
+// overlaps holding b (and everything below it, with bSubtree).
+func overlaps(a string, aSubtree bool, b string, bSubtree bool) bool {
+	return a == b || (aSubtree && isBelow(b, a)) || (bSubtree && isBelow(a, b))
+}
+
+// Returns the names of the locks that holding lock (and everything below
+// it, with subtree) may overlap: lock, every lock above it, and with
+// subtree every lock below it that has holders or waiters.
+// Precondition: ls.mu is locked.
+func (ls *LockService) related(lock string, subtree bool) []string {
+	names := []string{lock}
+	for parent := lock; parent != "/"; {
+		parent = path.Dir(parent)
+		names = append(names, parent)
+	}
+	if subtree {
+		names = append(names, ls.below(lock)...)
+	}
+	return names
+}
+
+// Returns the locks below lock that have holders or waiters, in name
+// order. Their names all start with lock's, so they are one range of the
+// index.
+// Precondition: ls.mu is locked.
+func (ls *LockService) below(lock string) []string {
+	prefix := lock + "/"
+	if lock == "/" {
+		prefix = lock
+	}
+	var names []string
+	for _, other := range ls.inUse[sort.SearchStrings(ls.inUse, prefix):] {
+		if !strings.HasPrefix(other, prefix) {
+			break
+		}
+		if other != lock {
+			names = append(names, other)
+		}
+	}
+	return names
+}
+
+// Adds lock to the index if it has holders or waiters, and removes it if
+// not. Called whenever they change.
+// Precondition: ls.mu is locked.
+func (ls *LockService) track(lock string) {
+	i := sort.SearchStrings(ls.inUse, lock)
+	indexed := i < len(ls.inUse) && ls.inUse[i] == lock
+	_, held := ls.locks[lock]
+	busy := held || len(ls.readers[lock]) > 0 || len(ls.waiters[lock]) > 0
+	if busy && !indexed {
+		ls.inUse = append(ls.inUse, "")
+		copy(ls.inUse[i+1:], ls.inUse[i:])
+		ls.inUse[i] = lock
+	} else if !busy && indexed {
+		ls.inUse = append(ls.inUse[:i], ls.inUse[i+1:]...)
+	}
+}
+
+// Rebuilds the index from the lock table.
+// Precondition: ls.mu is locked.
+func (ls *LockService) reindex() {
+	busy := make(map[string]bool)
+	for lock := range ls.locks {
+		busy[lock] = true
+	}
+	for lock := range ls.readers {
+		busy[lock] = true
+	}
+	for lock := range ls.waiters {
+		busy[lock] = true
+	}
+	ls.inUse = nil
+	for lock := range busy {
+		ls.inUse = append(ls.inUse, lock)
+	}
+	sort.Strings(ls.inUse)
+}
+
+// Returns whether the client of w can't be granted lock yet: another
+// client holds an overlapping lock in a conflicting mode, or got in line
+// for one before w did.
+// Precondition: ls.mu is locked.
+func (ls *LockService) blocked(lock string, w Waiter) bool {
+	for _, other := range ls.related(lock, w.Subtree) {
+		if owner, held := ls.locks[other]; held && owner != w.Client &&
+			overlaps(lock, w.Subtree, other, ls.subtrees[Hold{other, owner}]) {
+			return true
+		}
+		if !w.Shared {
+			for _, reader := range ls.readers[other] {
+				if reader != w.Client && overlaps(lock, w.Subtree, other, ls.subtrees[Hold{other, reader}]) {
+					return true
+				}
+			}
+		}
+		for _, ahead := range ls.waiters[other] {
+			if ahead.Position < w.Position && ahead.Client != w.Client && !(w.Shared && ahead.Shared) &&
+				overlaps(lock, w.Subtree, other, ahead.Subtree) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Hands off every lock that may have been freed when a client let go of
+// lock or left its line: lock itself and the locks above and below it.
+// Granting a lock never frees another, so one pass in name order grants
+// the same locks on every replica.
+// Precondition: ls.mu is locked.
+func (ls *LockService) handOffAround(lock string) {
+	related := ls.related(lock, true)
+	sort.Strings(related)
+	for _, other := range related {
+		if len(ls.waiters[other]) > 0 {
+			ls.handOff(other)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package lockservice
+
+import "reflect"
+import "testing"
+import "time"
+
+func TestSubtreeWaitsInLine(t *testing.T) {
+	sim, servers, services := makeSimCluster(4, 3)
+	holder := sim.MakeLockClient(servers...)
+	tree := sim.MakeLockClient(servers...)
+	leaf := sim.MakeLockClient(servers...)
+
+	var granted []string
+	sim.Go(func() {
+		holder.Lock("/t/x")
+		granted = append(granted, "holder")
+		sim.Sleep(10 * time.Second)
+		holder.Unlock("/t/x")
+	})
+	sim.Go(func() {
+		sim.Sleep(1 * time.Second)
+		tree.LockSubtree("/t")
+		granted = append(granted, "tree")
+		sim.Sleep(10 * time.Second)
+		tree.Unlock("/t")
+	})
+	sim.Go(func() {
+		// Free itself, but below /t, which tree got in line for first.
+		sim.Sleep(2 * time.Second)
+		leaf.Lock("/t/y")
+		granted = append(granted, "leaf")
+		leaf.Unlock("/t/y")
+	})
+	sim.Run(60 * time.Second)
+
+	if want := []string{"holder", "tree", "leaf"}; !reflect.DeepEqual(granted, want) {
+		t.Fatalf("granted %v, want %v", granted, want)
+	}
+	checkReplicasAgree(t, services)
+}
@@ -5,44 +5,109 @@ package lockservice
 // Multiple applications will run, each including
 // a Paxos peer.
 //
-// Manages a sequence of agreed-on values.
-// The set of peers is fixed.
+// Manages a sequence of agreed-on values. Values are opaque bytes;
+// TypedPaxos agrees on values of an application type, encoded by a Codec.
+// The set of peers can change: the application decides, through
+// agreed-on values, which Config to use for later instances, and tells
+// Paxos with Reconfigure(). Each instance is agreed on by a majority of
+// the peers in its own Config.
+// Runs as Multi-Paxos: a peer that wins a Prepare for an instance holds a
+// leader ballot for that instance and every later one, and proposes
+// further values with Accepts alone until a higher ballot shows up.
+// Other peers forward their proposals to the leader, and take over
+// leadership if it stops responding.
 // Copes with network failures (partition, msg loss, &c).
-// Does not store anything persistently, so cannot handle crash+restart.
+// Acceptor state is kept in a write-ahead log in dir, so a peer can
+// crash and restart without breaking its promises.
 //
 // The application interface:
 //
-// px = paxos.Make(peers []string, me string)
-// px.Start(seq int, v interface{}) -- start agreement on new instance
-// px.Status(seq int) (decided bool, v interface{}) -- get info about an instance
+// px = paxos.Make(config Config, me string, dir string, tr Transport, srv Server, sched Scheduler)
+// px.Start(seq int, v []byte) -- start agreement on new instance
+// px.Status(seq int) (decided bool, v []byte) -- get info about an instance
+// px.Wait(seq int) (decided bool, v []byte) -- wait until an instance is decided
+// px.Decisions(ctx context.Context, seq int) <-chan Decision -- every decided instance from seq on, in order, until ctx is done
 // px.Done(seq int) -- ok to forget all instances <= seq
 // px.Max() int -- highest instance seq known, or -1
 // px.Min() int -- instances before this seq have been forgotten
+// px.Forgotten(seq int) bool -- a peer forgot seq before this peer learned it
+// px.Reconfigure(config Config) -- use config for instances >= config.From
+// px.Kill() -- stop proposing and waiting, and close the log
 //
 
-import "net/rpc"
+import "context"
+import "errors"
+import "fmt"
 import "sync"
 import "math"
-
-//import "time"
+import "time"
 
 type Paxos struct {
-	mu         sync.Mutex
-	peers      []string
-	me         int // index into peers[]
+	mu sync.Mutex
+	me string // my address
+	id int    // my peer id, or -1 if I have none yet
 
 	// Your data here.
 	instances map[int]*InstanceInfo // map instance -> InstanceInfo
-	min       map[string]int        // map peer -> known done value
-	majority  int                   // Number of nodes required for a quorum
+	min       map[string]int        // map peer -> known done value, for peers in the latest Config
+	configs   []Config              // Every known Config, ordered by From
+	ids       map[int]string        // map peer id -> address, for every peer ever configured
+	log       *wal                  // Durable acceptor state, nil if not persisted
+	transport Transport             // Carries RPCs to the other peers
+	sched     Scheduler             // Runs goroutines and timers
+	changed   Cond                  // Signalled when an instance is decided or forgotten, or on Kill()
+	dead      bool                  // Set by Kill()
+
+	// Acceptor promise made to a leader's Prepare, covering every instance
+	// >= promisedFrom.
+	promised     int
+	promisedFrom int
+
+	// Proposer state.
+	highestBallot  int                   // The highest ballot seen from any peer.
+	leaderBallot   int                   // The ballot I lead with, or -1 if I'm not the leader.
+	leaderFrom     int                   // My leader ballot covers instances >= leaderFrom,
+	leaderConfig   int                   // as long as they use the Config starting at leaderConfig.
+	leaderAccepted map[int]AcceptedValue // Values reported in Phase 1 that I must propose.
+	forgottenBelow int                   // Some peer has forgotten every instance < forgottenBelow.
+}
+
+// How long to wait for the leader to decide a forwarded proposal before
+// taking over leadership.
+const forwardTimeout = 500 * time.Millisecond
+
+// Ballot n belongs to the peer with id n % maxPeerIds.
+const maxPeerIds = 1 << 16
+
+// The peers that agree on instances >= From, up to the From of the next
+// Config.
+type Config struct {
+	From  int
+	Peers []string
+	Ids   map[string]int // map address -> peer id, for at least every peer in Peers
+}
+
+// Returns whether peer is in the Config.
+func (config *Config) Contains(peer string) bool {
+	for _, p := range config.Peers {
+		if p == peer {
+			return true
+		}
+	}
+	return false
+}
+
+// Number of peers required for a quorum.
+func (config *Config) Majority() int {
+	return len(config.Peers)/2 + 1
 }
 
 // Per-instance state for prepares/accepts.
 type InstanceInfo struct {
-	HighestPrepare   int         // The highest prepare number seen (n_p).
-	HighestAccept    int         // The highest accept number seen (n_a).
-	HighestAcceptVal interface{} // The value corresponding to the highet accept (v_a).
-	Decided          bool        // Whether the highest value is the final value.
+	HighestPrepare   int    // The highest prepare number seen (n_p).
+	HighestAccept    int    // The highest accept number seen (n_a).
+	HighestAcceptVal []byte // The value corresponding to the highet accept (v_a).
+	Decided          bool   // Whether the highest value is the final value.
 }
 
 // RPC argument/reply definitions.
@@ -51,41 +116,68 @@ type PrepareArgs struct {
 	Proposal int // n
 }
 
+// A Prepare promises Proposal for Instance and every later instance.
 type PrepareReply struct {
 	Err              string
-	HighestAccept    int         // n_a
-	HighestAcceptVal interface{} // v_a
-	DecidedVal       interface{} // Used if this instance has already been decided
-	Done             int         // Piggyback done value
+	HighestAccept    int             // n_a
+	HighestAcceptVal []byte          // v_a
+	DecidedVal       []byte          // Used if this instance has already been decided
+	Accepted         []AcceptedValue // Accepted values of later instances
+	Promised         int             // n_p, used if the prepare was rejected
+	Done             int             // Piggyback done value
+}
+
+// An accepted value reported in a PrepareReply for an instance later than
+// the one being prepared.
+type AcceptedValue struct {
+	Instance int
+	Proposal int // n_a
+	Value    []byte
+	Decided  bool
 }
 
 type AcceptArgs struct {
 	Instance int
-	Proposal int         // n
-	Value    interface{} // v'
+	Proposal int    // n
+	Value    []byte // v'
 }
 
 type AcceptReply struct {
 	Err              string
 	AcceptedProposal int
-	DecidedVal       interface{} // Used if this instance has already been decided
-	Done             int         // Piggyback done value
+	DecidedVal       []byte // Used if this instance has already been decided
+	Promised         int    // n_p, used if the accept was rejected
+	Done             int    // Piggyback done value
 }
 
 type DecidedArgs struct {
 	Instance int
-	Value    interface{}
+	Value    []byte
+	Dones    map[string]int // The sender's view of every peer's done value
 }
 
 type DecidedReply struct {
 	Done int // piggyback done value
 }
 
+type ForwardArgs struct {
+	Instance int
+	Value    []byte
+	Config   int // The From of the Config the sender uses for Instance.
+}
+
+type ForwardReply struct {
+	Err string
+}
+
 const PrepareOk string = "PrepareOk"
 const PrepareReject string = "PrepareReject"
 const AcceptOk string = "AcceptOk"
 const AcceptReject string = "AcceptReject"
 const Decided string = "Decided"
+const Forgotten string = "Forgotten"
+const ForwardOk string = "ForwardOk"
+const NotLeader string = "NotLeader"
 
 //
 // the application wants paxos to start agreement on
@@ -94,10 +186,12 @@ const Decided string = "Decided"
 // call Status() to find out if/when agreement
 // is reached.
 //
-func (px *Paxos) Start(seq int, v interface{}) {
+func (px *Paxos) Start(seq int, v []byte) {
 	// fmt.Printf("node%v: Start(%v,%v)\n", px.me, seq, v)
+	px.mu.Lock()
 	// Can't start agreement on seq if it's already done.
 	if seq < px.Min() {
+		px.mu.Unlock()
 		return
 	}
 	// Can't start agreement on a number that's already started.
@@ -105,8 +199,9 @@ func (px *Paxos) Start(seq int, v interface{}) {
 	if !startedInstance {
 		px.instances[seq] = &InstanceInfo{-1, -1, nil, false}
 	}
+	px.mu.Unlock()
 
-	go px.propose(seq, v) // Start agreement on new thread.
+	px.sched.Go(func() { px.propose(seq, v) }) // Start agreement on new thread.
 }
 
 //
@@ -116,13 +211,63 @@ func (px *Paxos) Start(seq int, v interface{}) {
 // see the comments for Min() for more explanation.
 //
 func (px *Paxos) Done(seq int) {
-	px.min[px.peers[px.me]] = seq
+	px.recordDone(px.me, seq)
 	px.tryForget()
 }
 
+// Records the done value of peer, persisting it if it increased.
+func (px *Paxos) recordDone(peer string, done int) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	px.noteDone(peer, done)
+}
+
+// Done values of peers outside the latest Config are ignored.
+// Precondition: px.mu is locked.
+func (px *Paxos) noteDone(peer string, done int) {
+	if current, known := px.min[peer]; !known || done <= current {
+		return
+	}
+	px.min[peer] = done
+	px.persist(&walRecord{Type: walDone, Peer: peer, Done: done})
+	px.forget() // Min() may have increased.
+}
+
+// Writes the current state of instance seq to the write-ahead log.
+// Precondition: px.mu is locked.
+func (px *Paxos) persistInstance(seq int) {
+	px.persist(px.instanceRecord(seq))
+}
+
+// Precondition: px.mu is locked.
+func (px *Paxos) instanceRecord(seq int) *walRecord {
+	return &walRecord{Type: walInstance, Instance: seq, Info: *px.instances[seq]}
+}
+
+// Precondition: px.mu is locked.
+func (px *Paxos) promiseRecord() *walRecord {
+	return &walRecord{Type: walPromise, Instance: px.promisedFrom, Proposal: px.promised}
+}
+
+// Appends records to the write-ahead log. A peer that cannot write its log
+// cannot safely answer any more RPCs, so failures are fatal.
+// Precondition: px.mu is locked.
+func (px *Paxos) persist(records ...*walRecord) {
+	if px.log == nil {
+		return
+	}
+	if err := px.log.append(records...); err != nil {
+		panic(fmt.Sprintf("paxos: writing log: %v", err))
+	}
+}
+
 // Returns the instance marked as done for me.
 func (px *Paxos) getDone() int {
-	return px.min[px.peers[px.me]]
+	done, known := px.min[px.me]
+	if !known {
+		return -1
+	}
+	return done
 }
 
 //
@@ -131,6 +276,8 @@ func (px *Paxos) getDone() int {
 // this peer.
 //
 func (px *Paxos) Max() int {
+	px.mu.Lock()
+	defer px.mu.Unlock()
 	max := -1
 	for key, _ := range px.instances {
 		if key > max {
@@ -181,13 +328,49 @@ func (px *Paxos) Min() int {
 // Forget instances that are < Min().
 func (px *Paxos) tryForget() {
 	px.mu.Lock()
+	px.forget()
+	px.mu.Unlock()
+}
+
+// Precondition: px.mu is locked.
+func (px *Paxos) forget() {
 	min := px.Min()
+	forgot := false
 	for instance, _ := range px.instances {
 		if instance < min {
 			delete(px.instances, instance)
+			forgot = true
 		}
 	}
-	px.mu.Unlock()
+	for instance, _ := range px.leaderAccepted {
+		if instance < min {
+			delete(px.leaderAccepted, instance)
+		}
+	}
+	if forgot {
+		px.compactLog()
+		px.changed.Broadcast()
+	}
+}
+
+// Rewrites the write-ahead log with only the state that is still needed,
+// dropping records of forgotten instances.
+// Precondition: px.mu is locked.
+func (px *Paxos) compactLog() {
+	if px.log == nil {
+		return
+	}
+	records := make([]*walRecord, 0, len(px.min)+len(px.instances)+1)
+	records = append(records, px.promiseRecord())
+	for peer, done := range px.min {
+		records = append(records, &walRecord{Type: walDone, Peer: peer, Done: done})
+	}
+	for seq, _ := range px.instances {
+		records = append(records, px.instanceRecord(seq))
+	}
+	if err := px.log.rewrite(records); err != nil {
+		panic(fmt.Sprintf("paxos: compacting log: %v", err))
+	}
 }
 
 //
@@ -197,7 +380,7 @@ func (px *Paxos) tryForget() {
 // should just inspect the local peer state;
 // it should not contact other Paxos peers.
 //
-func (px *Paxos) Status(seq int) (bool, interface{}) {
+func (px *Paxos) Status(seq int) (bool, []byte) {
 	px.mu.Lock()
 	if seq < px.Min() {
 		px.mu.Unlock()
@@ -217,158 +400,613 @@ func (px *Paxos) Status(seq int) (bool, interface{}) {
 }
 
 // Propose that v is the value of instance seq.
-func (px *Paxos) propose(seq int, v interface{}) {
-
+func (px *Paxos) propose(seq int, v []byte) {
 	// fmt.Printf("node%v: propose(%v,%v)\n", px.me, seq, v)
+	for !px.isDecided(seq) && !px.Forgotten(seq) && !px.isDead() {
+		if proposal, acceptVal, leading := px.leaderProposal(seq, v); leading {
+			// Phase 1 is already done for seq: go straight to Accepts.
+			if px.sendAccepts(seq, proposal, acceptVal) {
+				px.sendDecides(seq, acceptVal)
+			} else {
+				px.backoff()
+			}
+			continue
+		}
+
+		// Let the current leader propose v, and wait for it to be decided.
+		if leader := px.currentLeader(); leader != px.me {
+			if px.forward(leader, seq, v) && px.waitDecided(seq, forwardTimeout) {
+				break
+			}
+		}
+
+		// There is no leader, or the leader isn't responding: take over.
+		if !px.becomeLeader(seq) {
+			px.backoff()
+		}
+	}
+	px.tryForget()
+}
+
+//
+// the application is done with this peer. it stops
+// proposing, and every Wait() returns at once. the
+// application closes the peer's Server itself.
+//
+func (px *Paxos) Kill() {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	px.dead = true
+	px.changed.Broadcast()
+
+	// Every append holds px.mu, so none is under way.
+	if px.log != nil {
+		px.log.close()
+		px.log = nil
+	}
+}
+
+// Returned by the RPC handlers of a killed peer, which can no longer
+// record what it promises or accepts.
+var errKilled = errors.New("paxos: peer killed")
+
+// Returns whether Kill() has been called.
+func (px *Paxos) isDead() bool {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	return px.dead
+}
+
+//
+// the application wants to know whether instance seq can
+// no longer be decided here because another peer has
+// already forgotten it. the application must then get
+// the state that instance led to from another peer.
+//
+func (px *Paxos) Forgotten(seq int) bool {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	return seq < px.forgottenBelow
+}
+
+// Records that a peer has forgotten instance seq.
+func (px *Paxos) noteForgotten(seq int) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if seq >= px.forgottenBelow {
+		px.forgottenBelow = seq + 1
+		px.changed.Broadcast()
+	}
+}
+
+// Returns whether instance seq has been decided (or forgotten).
+func (px *Paxos) isDecided(seq int) bool {
+	px.mu.Lock()
+	defer px.mu.Unlock()
 	instance := px.instances[seq]
-	proposal := px.me
-	for instance != nil && !instance.Decided {
-		prepareQuorum, acceptVal := px.sendPrepares(seq, proposal)
+	return instance == nil || instance.Decided
+}
 
-		if !prepareQuorum {
-			proposal += len(px.peers)
-			continue
+// Waits until instance seq is decided or the timeout expires. Returns
+// whether the instance was decided.
+func (px *Paxos) waitDecided(seq int, timeout time.Duration) bool {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	timedOut := false
+	timer := px.sched.AfterFunc(timeout, func() {
+		px.mu.Lock()
+		timedOut = true
+		px.changed.Broadcast()
+		px.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	for {
+		instance := px.instances[seq]
+		if instance == nil || instance.Decided {
+			return true
 		}
+		if timedOut || px.dead {
+			return false
+		}
+		px.changed.Wait()
+	}
+}
+
+//
+// the application wants to wait until instance seq is
+// decided. Wait() returns as soon as it is, with what
+// Status() would return. it returns false if seq is
+// forgotten first (see Forgotten()), or if this peer
+// is killed.
+//
+func (px *Paxos) Wait(seq int) (bool, []byte) {
+	return px.waitContext(context.Background(), seq)
+}
 
-		if acceptVal == nil {
-			acceptVal = v
+// Wait(), but also returns once ctx is done, which must
+// broadcast px.changed.
+func (px *Paxos) waitContext(ctx context.Context, seq int) (bool, []byte) {
+	px.mu.Lock()
+	for {
+		instance := px.instances[seq]
+		if seq < px.Min() || seq < px.forgottenBelow || (instance != nil && instance.Decided) || px.dead ||
+			ctx.Err() != nil {
+			break
 		}
+		px.changed.Wait()
+	}
+	px.mu.Unlock()
+	return px.Status(seq)
+}
 
-		acceptQuorum := px.sendAccepts(seq, proposal, acceptVal)
+// A decided instance, as sent by Decisions().
+type Decision struct {
+	Seq   int
+	Value []byte
+}
 
-		if !acceptQuorum {
-			proposal += len(px.peers)
-			continue
+//
+// the application wants every decided value in order.
+// Decisions() returns a channel that carries each instance
+// from seq on, as soon as it and every instance before it
+// have been decided. the channel is closed once ctx is
+// done, which is how the caller stops it, if this peer is
+// killed, or if an instance is forgotten before this peer
+// learns it (see Forgotten()). a Simulation can't wait on
+// a channel; use Wait() there.
+//
+func (px *Paxos) Decisions(ctx context.Context, seq int) <-chan Decision {
+	decisions := make(chan Decision)
+	timer := px.sched.AfterDone(ctx, func() {
+		px.mu.Lock()
+		px.changed.Broadcast()
+		px.mu.Unlock()
+	})
+	px.sched.Go(func() {
+		defer timer.Stop()
+		defer close(decisions)
+		for ; ; seq++ {
+			decided, v := px.waitContext(ctx, seq)
+			if !decided || ctx.Err() != nil {
+				return
+			}
+			select {
+			case decisions <- Decision{seq, v}:
+			case <-ctx.Done():
+				return
+			}
 		}
+	})
+	return decisions
+}
+
+// Sleeps for a short random time so dueling proposers don't keep
+// preempting each other.
+func (px *Paxos) backoff() {
+	px.sched.Sleep(time.Duration(10+px.sched.Int63n(40)) * time.Millisecond)
+}
 
-		px.sendDecides(seq, acceptVal)
+// If I hold a leader ballot covering seq, returns the ballot and the value
+// to propose for seq: the one reported during Phase 1 if there was one,
+// otherwise v.
+func (px *Paxos) leaderProposal(seq int, v []byte) (int, []byte, bool) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if px.leaderBallot < 0 || seq < px.leaderFrom {
+		return 0, nil, false
 	}
-	px.tryForget()
+	if px.configFor(seq).From != px.leaderConfig {
+		// Phase 1 was run with another Config's quorum, which doesn't
+		// count for seq.
+		return 0, nil, false
+	}
+	// Only one value may ever be proposed for seq with my ballot.
+	accepted, ok := px.leaderAccepted[seq]
+	if !ok {
+		accepted = AcceptedValue{seq, px.leaderBallot, v, false}
+		px.leaderAccepted[seq] = accepted
+	}
+	return px.leaderBallot, accepted.Value, true
 }
 
-// Send Prepare RPCs to all peers.
+// Returns the address of the peer that owns the highest ballot seen, or my
+// own address if no ballot has been seen yet or its owner is unknown.
+func (px *Paxos) currentLeader() string {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if px.highestBallot < 0 {
+		return px.me
+	}
+	leader, known := px.ids[px.highestBallot%maxPeerIds]
+	if !known {
+		return px.me
+	}
+	return leader
+}
+
+// Records that a peer is using ballot n. If it is higher than my own
+// leader ballot, I am no longer the leader.
+// Precondition: px.mu is locked.
+func (px *Paxos) noteBallot(n int) {
+	if n > px.highestBallot {
+		px.highestBallot = n
+	}
+	if px.leaderBallot >= 0 && n > px.leaderBallot {
+		px.leaderBallot = -1
+		px.leaderAccepted = nil
+	}
+}
+
+// Returns a ballot that belongs to me and is higher than any seen so far.
+// Returns false if I have no peer id to own a ballot with.
+func (px *Paxos) nextBallot() (int, bool) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if px.id < 0 {
+		return 0, false
+	}
+	return (px.highestBallot/maxPeerIds+1)*maxPeerIds + px.id, true
+}
+
+// Asks the leader to propose v for instance seq. Returns whether the
+// leader agreed to.
+func (px *Paxos) forward(leader string, seq int, v []byte) bool {
+	args := ForwardArgs{seq, v, px.config(seq).From}
+	var reply ForwardReply
+	ok := px.transport.Call(leader, "Paxos.Forward", &args, &reply)
+	return ok && reply.Err == ForwardOk
+}
+
+// Returns the Config used for instance seq.
+func (px *Paxos) config(seq int) Config {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	return *px.configFor(seq)
+}
+
+// Precondition: px.mu is locked.
+func (px *Paxos) configFor(seq int) *Config {
+	config := &px.configs[0]
+	for i := range px.configs {
+		if px.configs[i].From <= seq {
+			config = &px.configs[i]
+		}
+	}
+	return config
+}
+
+//
+// the application has agreed that instances >= config.From
+// are to be decided by config.Peers. Configs must be given
+// in order of From; giving a Config again replaces it and
+// any later ones. the application must not Start() an
+// instance until it has given Paxos the Config for it.
+//
+func (px *Paxos) Reconfigure(config Config) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	px.addConfig(config)
+
+	// Peers that join start out done with everything forgotten so far, so
+	// that Min() doesn't go back down; peers that left no longer hold it
+	// back.
+	min := px.Min()
+	for _, peer := range config.Peers {
+		if _, known := px.min[peer]; !known {
+			px.min[peer] = min - 1
+			px.persist(&walRecord{Type: walDone, Peer: peer, Done: min - 1})
+		}
+	}
+	for peer, _ := range px.min {
+		if !config.Contains(peer) {
+			delete(px.min, peer)
+		}
+	}
+	px.forget()
+}
+
+// Precondition: px.mu is locked.
+func (px *Paxos) addConfig(config Config) {
+	i := 0
+	for i < len(px.configs) && px.configs[i].From < config.From {
+		i++
+	}
+	px.configs = append(px.configs[:i], config)
+	for peer, id := range config.Ids {
+		px.ids[id] = peer
+		if peer == px.me {
+			px.id = id
+		}
+	}
+}
+
+// Runs Phase 1 for instance seq and every later instance with a new
+// ballot. On success I become the leader, and remember the values that
+// acceptors reported so they are the ones proposed.
+// Returns whether I became the leader.
+func (px *Paxos) becomeLeader(seq int) bool {
+	proposal, ok := px.nextBallot()
+	if !ok {
+		return false
+	}
+	config := px.config(seq)
+	prepareQuorum, accepted := px.sendPrepares(seq, proposal, &config)
+	if !prepareQuorum {
+		return false
+	}
+
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if proposal < px.highestBallot {
+		// Someone else prepared a higher ballot in the meantime.
+		return false
+	}
+	px.leaderBallot = proposal
+	px.leaderFrom = seq
+	px.leaderConfig = config.From
+	px.leaderAccepted = make(map[int]AcceptedValue)
+	for instance, value := range accepted {
+		if value.Decided {
+			px.learn(instance, value.Value)
+		} else {
+			px.leaderAccepted[instance] = value
+		}
+	}
+	return true
+}
+
+// Sends an RPC to every one of peers concurrently. send is called once per peer on
+// its own goroutine; it makes the call and returns the reply, or nil if the
+// peer could not be reached. Replies are passed to handle one at a time, in
+// the order they arrive, and handle returns true once the round is settled
+// (a quorum was reached or can no longer be). fanout returns at that point,
+// or once every peer has answered, without waiting for slow peers. send
+// should record anything piggybacked on a reply itself, so that replies
+// arriving after fanout returned are not lost.
+func (px *Paxos) fanout(peers []string, send func(peer string) interface{}, handle func(reply interface{}) bool) {
+	var mu sync.Mutex
+	arrived := px.sched.NewCond(&mu)
+	var replies []interface{}
+
+	for _, peer := range peers {
+		peer := peer
+		px.sched.Go(func() {
+			reply := send(peer)
+			mu.Lock()
+			replies = append(replies, reply)
+			arrived.Signal()
+			mu.Unlock()
+		})
+	}
+
+	for i := 0; i < len(peers); i++ {
+		mu.Lock()
+		for len(replies) == 0 {
+			arrived.Wait()
+		}
+		reply := replies[0]
+		replies = replies[1:]
+		mu.Unlock()
+
+		if handle(reply) {
+			return
+		}
+	}
+}
+
+// Send Prepare RPCs to all peers in config. The prepare covers seq and
+// every later instance.
 // Parameters:
-//   seq int      - The instance to propose for.
-//   proposal int - The propsal number.
+//   seq int        - The instance to propose for.
+//   proposal int   - The propsal number.
+//   config *Config - The Config of seq.
 // Return values:
 //   bool - true if a quorum of prepare_oks was reached
-//   interface{} - the highest accept value received from prepare_ok replies.
-func (px *Paxos) sendPrepares(seq int, proposal int) (bool, interface{}) {
-	prepareOks := 0 // Number of OKs.
-
-	// Track v_a of highest n_a from prepare oks.
-	highestAccept := -1              // n_a
-	var highestAcceptVal interface{} // v_a
+//   map[int]AcceptedValue - the value of the highest accept received from
+//                           prepare_ok replies for seq and later instances.
+func (px *Paxos) sendPrepares(seq int, proposal int, config *Config) (bool, map[int]AcceptedValue) {
+	prepareOks := 0   // Number of OKs.
+	prepareFails := 0 // Number of rejects and unreachable peers.
+	decided := false
+	var decidedVal []byte
+
+	// Track v_a of highest n_a from prepare oks, per instance.
+	accepted := make(map[int]AcceptedValue)
+	record := func(value AcceptedValue) {
+		highest, seen := accepted[value.Instance]
+		if !seen || (!highest.Decided && (value.Decided || value.Proposal > highest.Proposal)) {
+			accepted[value.Instance] = value
+		}
+	}
 
-	// Loop through the peers and send each one a Prepare RPC.
-	for _, peer := range px.peers {
+	// Send each peer a Prepare RPC.
+	send := func(peer string) interface{} {
 		args := PrepareArgs{seq, proposal}
 		var reply PrepareReply
 		var success bool
 
-		if peer == px.peers[px.me] {
+		if peer == px.me {
 			// Call method directly for the local acceptor.
-			reply = PrepareReply{"", 0, nil, nil, 0}
 			px.Prepare(&args, &reply)
 			success = true
 		} else {
-			success = call(peer, "Paxos.Prepare", &args, &reply)
+			success = px.transport.Call(peer, "Paxos.Prepare", &args, &reply)
 		}
 
 		if !success {
-			continue
+			return nil
 		}
+		px.recordDone(peer, reply.Done) // Record the done value.
+		return &reply
+	}
 
-		px.min[peer] = reply.Done // Record the done value.
-
-		if reply.Err == PrepareOk {
+	majority := config.Majority()
+	px.fanout(config.Peers, send, func(r interface{}) bool {
+		reply, _ := r.(*PrepareReply)
+		if reply == nil {
+			prepareFails++
+		} else if reply.Err == PrepareOk {
 			prepareOks++
-			if reply.HighestAccept > highestAccept {
-				highestAccept = reply.HighestAccept
-				highestAcceptVal = reply.HighestAcceptVal
+			if reply.HighestAccept >= 0 {
+				record(AcceptedValue{seq, reply.HighestAccept, reply.HighestAcceptVal, false})
+			}
+			for _, value := range reply.Accepted {
+				record(value)
 			}
 		} else if reply.Err == Decided {
-			// If the instance has been decided then broadcast decides to get
-			// back up to date.
-			px.sendDecides(seq, reply.DecidedVal)
-			break
+			decided = true
+			decidedVal = reply.DecidedVal
+			return true
+		} else if reply.Err == Forgotten {
+			prepareFails++
+			px.noteForgotten(seq)
+		} else {
+			prepareFails++
+			px.mu.Lock()
+			px.noteBallot(reply.Promised)
+			px.mu.Unlock()
 		}
+		return prepareOks >= majority || prepareFails > len(config.Peers)-majority
+	})
+
+	if decided {
+		// If the instance has been decided then broadcast decides to get
+		// back up to date.
+		px.sendDecides(seq, decidedVal)
+		return false, accepted
 	}
-	return prepareOks >= px.majority, highestAcceptVal
+	return prepareOks >= majority, accepted
 }
 
-// Send Accept RPCs to all peers.
+// Send Accept RPCs to all peers in the Config of seq.
 // Parameters:
 //   seq int               - The instance to seek Accepts for.
 //   proposal int          - The proposal to be accepted.
-//   acceptVal interface{} - The value to be accepted.
+//   acceptVal []byte      - The value to be accepted.
 // Returns true if a quorum of AcceptOks was reached.
-func (px *Paxos) sendAccepts(seq int, proposal int, acceptVal interface{}) bool {
-	acceptOks := 0 // Number of OKs.
-
-	// Loop through all peers and send an accept RPC.
-	for _, peer := range px.peers {
+func (px *Paxos) sendAccepts(seq int, proposal int, acceptVal []byte) bool {
+	config := px.config(seq)
+	majority := config.Majority()
+	acceptOks := 0   // Number of OKs.
+	acceptFails := 0 // Number of rejects and unreachable peers.
+	decided := false
+	var decidedVal []byte
+
+	// Send each peer an accept RPC.
+	send := func(peer string) interface{} {
 		args := AcceptArgs{seq, proposal, acceptVal}
 		var reply AcceptReply
 		var success bool
 
-		if peer == px.peers[px.me] {
+		if peer == px.me {
 			// Call method directly for the local acceptor.
-			reply = AcceptReply{"", 0, nil, 0}
 			px.Accept(&args, &reply)
 			success = true
 		} else {
-			success = call(peer, "Paxos.Accept", &args, &reply)
+			success = px.transport.Call(peer, "Paxos.Accept", &args, &reply)
 		}
+
 		if !success {
-			continue
+			return nil
 		}
-		px.min[peer] = reply.Done // Record the done value.
+		px.recordDone(peer, reply.Done) // Record the done value.
+		return &reply
+	}
 
-		if reply.Err == AcceptOk && reply.AcceptedProposal == proposal {
+	px.fanout(config.Peers, send, func(r interface{}) bool {
+		reply, _ := r.(*AcceptReply)
+		if reply == nil {
+			acceptFails++
+		} else if reply.Err == AcceptOk && reply.AcceptedProposal == proposal {
 			acceptOks++
 		} else if reply.Err == Decided {
-			// If the instance has been decided then broadcast decides to get
-			// back up to date.
-			px.sendDecides(seq, reply.DecidedVal)
-			break
+			decided = true
+			decidedVal = reply.DecidedVal
+			return true
+		} else if reply.Err == Forgotten {
+			acceptFails++
+			px.noteForgotten(seq)
+		} else {
+			// A higher ballot has been promised, so I may no longer lead.
+			acceptFails++
+			px.mu.Lock()
+			px.noteBallot(reply.Promised)
+			px.mu.Unlock()
 		}
+		return acceptOks >= majority || acceptFails > len(config.Peers)-majority
+	})
+
+	if decided {
+		// If the instance has been decided then broadcast decides to get
+		// back up to date.
+		px.sendDecides(seq, decidedVal)
+		return false
 	}
-	return acceptOks >= px.majority
+	return acceptOks >= majority
 }
 
-// Send Decided RPCs to all peers. (Also decides self node)
+// Send Decided RPCs to all peers in the Config of seq. (Also decides self
+// node)
+// Returns once a majority has learned the value; the remaining peers are
+// told in the background.
 // Parameters:
 //   seq int         - The instance to decide.
-//   val interface{} - The decided value.
-func (px *Paxos) sendDecides(seq int, val interface{}) {
-	for _, peer := range px.peers {
-		args := DecidedArgs{seq, val}
+//   val []byte      - The decided value.
+func (px *Paxos) sendDecides(seq int, val []byte) {
+	answered := 0
+
+	// Pass on the done values I know of, so that peers that never send
+	// Paxos RPCs themselves (because they forward to a leader) can still
+	// advance Min().
+	px.mu.Lock()
+	dones := make(map[string]int)
+	for peer, done := range px.min {
+		dones[peer] = done
+	}
+	config := *px.configFor(seq)
+	px.mu.Unlock()
+
+	send := func(peer string) interface{} {
+		args := DecidedArgs{seq, val, dones}
 		var reply DecidedReply
 		var success bool
 
-		if peer == px.peers[px.me] {
+		if peer == px.me {
 			// Call method directly for local learner.
-			reply = DecidedReply{0}
 			px.Decided(&args, &reply)
 			success = true
 		} else {
-			success = call(peer, "Paxos.Decided", &args, &reply)
+			success = px.transport.Call(peer, "Paxos.Decided", &args, &reply)
 		}
 
-		if success {
-			px.min[peer] = reply.Done // Record the done value.
+		if !success {
+			return nil
 		}
+		px.recordDone(peer, reply.Done) // Record the done value.
+		return &reply
 	}
+
+	px.fanout(config.Peers, send, func(r interface{}) bool {
+		if r != nil {
+			answered++
+		}
+		return answered >= config.Majority()
+	})
 }
 
 func (px *Paxos) Prepare(args *PrepareArgs, reply *PrepareReply) error {
 	px.mu.Lock()
+	if px.dead {
+		px.mu.Unlock()
+		return errKilled
+	}
 	reply.Done = px.getDone() // Piggyback the done value.
 
 	// If we are all done with this instance, reject.
 	if args.Instance < px.Min() {
-		reply.Err = PrepareReject
+		reply.Err = Forgotten
 		px.mu.Unlock()
 		return nil
 	}
@@ -388,29 +1026,63 @@ func (px *Paxos) Prepare(args *PrepareArgs, reply *PrepareReply) error {
 		return nil
 	}
 
-	if args.Proposal <= instance.HighestPrepare {
+	promised := px.promisedFor(args.Instance)
+	if px.promised > promised {
+		promised = px.promised
+	}
+	if args.Proposal <= promised {
 		// The prepare proposal is less than or equal to one I've seen before.
 		reply.Err = PrepareReject
+		reply.Promised = promised
 		px.mu.Unlock()
 		return nil
 	}
 
-	// The prepare proposal is the highest one seen.
+	// The prepare proposal is the highest one seen. Promise it for this
+	// instance and every later one, durably, before replying.
 	instance.HighestPrepare = args.Proposal
+	if px.promised < 0 || args.Instance < px.promisedFrom {
+		px.promisedFrom = args.Instance
+	}
+	px.promised = args.Proposal
+	px.noteBallot(args.Proposal)
+	px.persist(px.instanceRecord(args.Instance), px.promiseRecord())
+
 	reply.Err = PrepareOk
 	reply.HighestAccept = instance.HighestAccept
 	reply.HighestAcceptVal = instance.HighestAcceptVal
+	for seq, later := range px.instances {
+		if seq > args.Instance && (later.HighestAccept >= 0 || later.Decided) {
+			reply.Accepted = append(reply.Accepted,
+				AcceptedValue{seq, later.HighestAccept, later.HighestAcceptVal, later.Decided})
+		}
+	}
 	px.mu.Unlock()
 	return nil
 }
 
+// Returns the highest proposal promised for instance seq, counting both
+// prepares for the instance itself and a leader's prepare covering it.
+// Precondition: px.mu is locked and seq has an InstanceInfo.
+func (px *Paxos) promisedFor(seq int) int {
+	promised := px.instances[seq].HighestPrepare
+	if seq >= px.promisedFrom && px.promised > promised {
+		promised = px.promised
+	}
+	return promised
+}
+
 func (px *Paxos) Accept(args *AcceptArgs, reply *AcceptReply) error {
 	px.mu.Lock()
+	if px.dead {
+		px.mu.Unlock()
+		return errKilled
+	}
 	reply.Done = px.getDone() // Piggyback the done value.
 
 	// If we are all done with this instance, reject.
 	if args.Instance < px.Min() {
-		reply.Err = AcceptReject
+		reply.Err = Forgotten
 		px.mu.Unlock()
 		return nil
 	}
@@ -430,17 +1102,20 @@ func (px *Paxos) Accept(args *AcceptArgs, reply *AcceptReply) error {
 		return nil
 	}
 
-	if args.Proposal < instance.HighestPrepare {
+	if promised := px.promisedFor(args.Instance); args.Proposal < promised {
 		// The accept proposal is lower than one I've seen before.
 		reply.Err = AcceptReject
+		reply.Promised = promised
 		px.mu.Unlock()
 		return nil
 	}
 
 	// The accept proposal is the highest one seen.
+	px.noteBallot(args.Proposal)
 	instance.HighestPrepare = args.Proposal
 	instance.HighestAccept = args.Proposal
 	instance.HighestAcceptVal = args.Value
+	px.persistInstance(args.Instance)
 	reply.Err = AcceptOk
 	reply.AcceptedProposal = args.Proposal
 	px.mu.Unlock()
@@ -449,52 +1124,135 @@ func (px *Paxos) Accept(args *AcceptArgs, reply *AcceptReply) error {
 
 func (px *Paxos) Decided(args *DecidedArgs, reply *DecidedReply) error {
 	px.mu.Lock()
+	if px.dead {
+		px.mu.Unlock()
+		return errKilled
+	}
 	reply.Done = px.getDone()
 
+	for peer, done := range args.Dones {
+		px.noteDone(peer, done)
+	}
+
 	// If we're all done with the instance then don't bother with deciding
 	if args.Instance < px.Min() {
 		px.mu.Unlock()
 		return nil
 	}
 
-	instance, hasInstance := px.instances[args.Instance]
+	px.learn(args.Instance, args.Value)
+	px.mu.Unlock()
+	return nil
+}
+
+// Records that instance seq was decided with value v.
+// Precondition: px.mu is locked.
+func (px *Paxos) learn(seq int, v []byte) {
+	instance, hasInstance := px.instances[seq]
 	if !hasInstance {
 		instance = &InstanceInfo{-1, -1, nil, false}
-		px.instances[args.Instance] = instance
+		px.instances[seq] = instance
 	}
 
 	if instance.Decided {
-		px.mu.Unlock()
-		return nil
+		return
 	}
 
 	instance.Decided = true
-	instance.HighestAcceptVal = args.Value
+	instance.HighestAcceptVal = v
+	px.persistInstance(seq)
+	px.changed.Broadcast()
+}
+
+// RPC Handler: another peer asks me, as leader, to propose a value. I
+// refuse if I don't know the Config the sender uses for the instance yet.
+func (px *Paxos) Forward(args *ForwardArgs, reply *ForwardReply) error {
+	px.mu.Lock()
+	leading := px.leaderBallot >= 0 && args.Instance >= px.leaderFrom &&
+		px.configFor(args.Instance).From == args.Config
 	px.mu.Unlock()
+
+	if !leading {
+		reply.Err = NotLeader
+		return nil
+	}
+
+	px.Start(args.Instance, args.Value)
+	reply.Err = ForwardOk
 	return nil
 }
 
 //
 // the application wants to create a paxos peer.
-// the ports of all the paxos peers (including this one)
-// are in peers[]. this servers port is peers[me].
+// the ports of the paxos peers are in config.Peers,
+// starting with instance config.From. this servers
+// port is me, which need not be in config.Peers yet.
+// durable state is kept in dir, and recovered from there
+// if the peer is restarting. an empty dir keeps nothing
+// on disk. RPCs to other peers are sent with tr, and the
+// peer's own RPC handlers are registered with srv. all
+// goroutines and timers are run by sched.
 //
-func MakePaxos(peers []string, me int) *Paxos {
+func MakePaxos(config Config, me string, dir string, tr Transport, srv Server, sched Scheduler) *Paxos {
 	px := &Paxos{}
-	px.peers = peers
 	px.me = me
+	px.id = -1
+	px.transport = tr
+	px.sched = sched
+	px.changed = sched.NewCond(&px.mu)
 
 	// Your initialization code here.
 	px.instances = make(map[int]*InstanceInfo)
 
+	px.ids = make(map[int]string)
+	px.addConfig(config)
+
 	px.min = make(map[string]int)
-	for _, peer := range px.peers {
+	for _, peer := range config.Peers {
 		px.min[peer] = -1
 	}
 
-	px.majority = len(px.peers)/2 + 1
+	px.promised = -1
+	px.highestBallot = -1
+	px.leaderBallot = -1
+
+	if dir != "" {
+		px.recover(dir)
+	}
 
-	rpc.Register(px)
+	if err := srv.Register(px); err != nil {
+		panic(err)
+	}
 
 	return px
 }
+
+// Opens the write-ahead log in dir and restores the state recorded in it.
+func (px *Paxos) recover(dir string) {
+	log, err := openWal(dir)
+	if err != nil {
+		panic(fmt.Sprintf("paxos: opening log: %v", err))
+	}
+
+	err = log.replay(func(record *walRecord) {
+		switch record.Type {
+		case walInstance:
+			info := record.Info
+			px.instances[record.Instance] = &info
+		case walDone:
+			if done, known := px.min[record.Peer]; known && record.Done > done {
+				px.min[record.Peer] = record.Done
+			}
+		case walPromise:
+			px.promised = record.Proposal
+			px.promisedFrom = record.Instance
+			px.noteBallot(record.Proposal)
+		}
+	})
+	if err != nil {
+		panic(fmt.Sprintf("paxos: replaying log: %v", err))
+	}
+
+	px.log = log
+	px.tryForget()
+}
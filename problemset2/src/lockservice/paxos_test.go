@@ -0,0 +1,143 @@
+package lockservice
+
+import "context"
+import "os"
+import "reflect"
+import "testing"
+import "time"
+
+func TestLeaderFailover(t *testing.T) {
+	sim, servers, services := makeSimCluster(1, 3)
+	lc := sim.MakeLockClient(servers...)
+
+	var leader string
+	var first, second int
+	var errs []Err
+	sim.Go(func() {
+		token, err := lc.Lock("/a")
+		first = token
+		errs = append(errs, err, lc.Unlock("/a"))
+
+		leader = services[0].px.currentLeader()
+		sim.Network().Isolate(leader)
+
+		token, err = lc.Lock("/a")
+		second = token
+		errs = append(errs, err, lc.Unlock("/a"))
+	})
+	sim.Run(60 * time.Second)
+
+	if want := []Err{OK, OK, OK, OK}; !reflect.DeepEqual(errs, want) {
+		t.Fatalf("got %v with %v isolated, want %v", errs, leader, want)
+	}
+	if second <= first {
+		t.Fatalf("got token %v after failover, want more than %v", second, first)
+	}
+	var rest []*LockService
+	for i, ls := range services {
+		if servers[i] != leader {
+			rest = append(rest, ls)
+		}
+	}
+	checkReplicasAgree(t, rest)
+}
+
+// Killing a peer closes its log, so a process can restart it on the same
+// directory again and again.
+func TestKillClosesLog(t *testing.T) {
+	dir := t.TempDir()
+	servers := []string{"n0"}
+	openFiles := func() int {
+		fds, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Skipf("can't count open files: %v", err)
+		}
+		return len(fds)
+	}
+
+	var before int
+	for i := 0; i < 5; i++ {
+		sim := MakeSimulation(int64(i))
+		ls := MakeLockService(servers, 0, dir, sim.Network().Transport("n0"), sim)
+		lc := sim.MakeLockClient(servers...)
+		var err Err
+		sim.Go(func() {
+			if i == 0 {
+				_, err = lc.Lock("/a")
+			} else {
+				_, err = lc.TryLock("/a")
+			}
+		})
+		sim.Run(10 * time.Second)
+		ls.Kill()
+
+		if want := map[bool]Err{true: OK, false: Locked}[i == 0]; err != want {
+			t.Fatalf("run %v: got %v, want %v", i, err, want)
+		}
+		if i == 0 {
+			before = openFiles()
+		}
+	}
+	if after := openFiles(); after > before {
+		t.Fatalf("%v files open after restarting 4 times, up from %v", after, before)
+	}
+}
+
+// Decisions carries every decided instance in order, and is closed once
+// its context is done or the peer is killed.
+func TestDecisions(t *testing.T) {
+	tr := MakeMemoryTransport()
+	peers := []string{"d0", "d1", "d2"}
+	config := Config{0, peers, map[string]int{"d0": 0, "d1": 1, "d2": 2}}
+	var pxa []*Paxos
+	for _, peer := range peers {
+		srv, err := tr.Serve(peer)
+		if err != nil {
+			t.Fatalf("Serve: %v", err)
+		}
+		pxa = append(pxa, MakePaxos(config, peer, "", tr, srv, MakeRealScheduler()))
+	}
+	defer func() {
+		for _, px := range pxa {
+			px.Kill()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	decisions := pxa[1].Decisions(ctx, 0)
+	// Decided out of order, but carried in order.
+	for _, seq := range []int{2, 0, 1} {
+		pxa[0].Start(seq, []byte{byte(seq)})
+	}
+	for want := 0; want < 3; want++ {
+		select {
+		case d := <-decisions:
+			if d.Seq != want || !reflect.DeepEqual(d.Value, []byte{byte(want)}) {
+				t.Fatalf("got decision %v = %v, want %v = %v", d.Seq, d.Value, want, []byte{byte(want)})
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no decision for %v", want)
+		}
+	}
+
+	cancel()
+	select {
+	case d, open := <-decisions:
+		if open {
+			t.Fatalf("got decision %v after cancel", d.Seq)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Decisions not closed after cancel")
+	}
+
+	decisions = pxa[2].Decisions(context.Background(), 3)
+	pxa[2].Kill()
+	select {
+	case d, open := <-decisions:
+		if open {
+			t.Fatalf("got decision %v from a killed peer", d.Seq)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Decisions not closed after Kill")
+	}
+}
@@ -0,0 +1,219 @@
+package lockservice
+
+//
+// A pool of long-lived RPC connections, one per server. net/rpc
+// multiplexes concurrent calls over a connection, so every call to a
+// server shares its one connection instead of dialing its own. A
+// connection that breaks is closed, and the next call to that server
+// dials a new one.
+//
+// Every call, dial included, fails after callTimeout, except calls that
+// wait on the server by design: a Lock waits for its lock, and a Watch
+// for a change. Those fail only when their connection does. A call that
+// times out drops its connection too, since a server that doesn't answer
+// may be behind a connection that is silently dead; any waiting calls on
+// it fail and are retried like any other failed call.
+//
+
+import "bufio"
+import "errors"
+import "io"
+import "net"
+import "net/http"
+import "net/rpc"
+import "reflect"
+import "sync"
+import "time"
+
+// How long a call may take before it counts as failed. A variable so
+// tests can shorten it.
+var callTimeout = 5 * time.Second
+
+// Calls that block on the server until something happens.
+var waitingCalls = map[string]bool{
+	"LockService.Lock":  true,
+	"LockService.Watch": true,
+}
+
+type connPool struct {
+	mu    sync.Mutex
+	conns map[string]*poolConn                  // map server -> its connection
+	dial  func(srv string) (*rpc.Client, error) // Opens a new connection to a server.
+}
+
+type poolConn struct {
+	mu     sync.Mutex // Held while dialing, so only one dial is made at a time.
+	client *rpc.Client
+}
+
+func makeConnPool(dial func(srv string) (*rpc.Client, error)) *connPool {
+	return &connPool{conns: make(map[string]*poolConn), dial: dial}
+}
+
+// Returns the connection to srv, dialing it if there is none. Returns
+// whether the connection was dialed for this call.
+func (cp *connPool) get(srv string) (*rpc.Client, bool, error) {
+	cp.mu.Lock()
+	pc, exists := cp.conns[srv]
+	if !exists {
+		pc = new(poolConn)
+		cp.conns[srv] = pc
+	}
+	cp.mu.Unlock()
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.client != nil {
+		return pc.client, false, nil
+	}
+	client, err := cp.dial(srv)
+	if err != nil {
+		return nil, false, err
+	}
+	pc.client = client
+	return client, true, nil
+}
+
+// Closes the connection to srv if it is still client.
+func (cp *connPool) drop(srv string, client *rpc.Client) {
+	cp.mu.Lock()
+	pc := cp.conns[srv]
+	cp.mu.Unlock()
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.client == client {
+		pc.client.Close()
+		pc.client = nil
+	}
+}
+
+// Makes a call to srv over its pooled connection. A pooled connection
+// found to be closed already is redialed and the call retried once, as
+// the call can't have been sent.
+func (cp *connPool) call(srv string, rpcname string, args interface{}, reply interface{}) bool {
+	for {
+		client, dialed, err := cp.get(srv)
+		if err != nil {
+			return false
+		}
+
+		err = callWithTimeout(client, rpcname, args, reply)
+		if err == nil {
+			return true
+		}
+		if _, handlerErr := err.(rpc.ServerError); handlerErr {
+			// The connection still works.
+			return false
+		}
+
+		cp.drop(srv, client)
+		if err != rpc.ErrShutdown || dialed {
+			return false
+		}
+	}
+}
+
+var errCallTimeout = errors.New("rpc: call timed out")
+
+// Makes a call with client, giving up after callTimeout unless the call
+// waits on the server. A reply that comes after that is thrown away.
+func callWithTimeout(client *rpc.Client, rpcname string, args interface{}, reply interface{}) error {
+	if waitingCalls[rpcname] {
+		return client.Call(rpcname, args, reply)
+	}
+
+	// Decode into a reply of my own, which a late reply can't race with.
+	late := reflect.New(reflect.TypeOf(reply).Elem())
+	call := client.Go(rpcname, args, late.Interface(), make(chan *rpc.Call, 1))
+	timer := time.NewTimer(callTimeout)
+	defer timer.Stop()
+	select {
+	case <-call.Done:
+		if call.Error == nil {
+			reflect.ValueOf(reply).Elem().Set(late.Elem())
+		}
+		return call.Error
+	case <-timer.C:
+		return errCallTimeout
+	}
+}
+
+// Connects to an RPC server behind HTTP CONNECT, as rpc.DialHTTP does,
+// but gives up after callTimeout.
+func dialHTTP(network string, address string) (*rpc.Client, error) {
+	conn, err := net.DialTimeout(network, address, callTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(callTimeout))
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	conn.SetDeadline(time.Time{})
+	if err == nil && resp.Status == "200 Connected to Go RPC" {
+		return rpc.NewClient(conn), nil
+	}
+	if err == nil {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	conn.Close()
+	return nil, err
+}
+
+// A listener that keeps track of the connections it accepted, so that
+// closing a server also cuts off the clients still connected to it.
+type trackingListener struct {
+	net.Listener
+	mu     sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+}
+
+type trackedConn struct {
+	net.Conn
+	listener *trackingListener
+}
+
+func trackConns(listener net.Listener) *trackingListener {
+	return &trackingListener{Listener: listener, conns: make(map[net.Conn]bool)}
+}
+
+func (tl *trackingListener) Accept() (net.Conn, error) {
+	conn, err := tl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tc := &trackedConn{conn, tl}
+
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	if tl.closed {
+		conn.Close()
+		return nil, net.ErrClosed
+	}
+	tl.conns[tc] = true
+	return tc, nil
+}
+
+func (tl *trackingListener) Close() error {
+	tl.mu.Lock()
+	tl.closed = true
+	var conns []net.Conn
+	for conn := range tl.conns {
+		conns = append(conns, conn)
+	}
+	tl.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return tl.Listener.Close()
+}
+
+func (tc *trackedConn) Close() error {
+	tc.listener.mu.Lock()
+	delete(tc.listener.conns, tc)
+	tc.listener.mu.Unlock()
+	return tc.Conn.Close()
+}
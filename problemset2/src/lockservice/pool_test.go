@@ -0,0 +1,119 @@
+package lockservice
+
+import "net"
+import "net/rpc"
+import "sync"
+import "testing"
+import "time"
+
+type PoolTestServer struct {
+	release chan bool
+}
+
+type PoolTestArgs struct{}
+
+type PoolTestReply struct{ Err Err }
+
+func (s *PoolTestServer) Fast(args *PoolTestArgs, reply *PoolTestReply) error {
+	reply.Err = OK
+	return nil
+}
+
+func (s *PoolTestServer) Slow(args *PoolTestArgs, reply *PoolTestReply) error {
+	<-s.release
+	reply.Err = OK
+	return nil
+}
+
+// Starts an RPC server on a local port. Returns its address, its
+// listener, and a pool that counts the connections it dials.
+func startPoolTest(t *testing.T) (string, *trackingListener, *connPool, func() int) {
+	server := rpc.NewServer()
+	srv := &PoolTestServer{make(chan bool)}
+	server.Register(srv)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	tl := trackConns(listener)
+	go server.Accept(tl)
+	t.Cleanup(func() {
+		close(srv.release)
+		tl.Close()
+	})
+
+	var mu sync.Mutex
+	dials := 0
+	pool := makeConnPool(func(addr string) (*rpc.Client, error) {
+		mu.Lock()
+		dials++
+		mu.Unlock()
+		return rpc.Dial("tcp", addr)
+	})
+	return listener.Addr().String(), tl, pool, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return dials
+	}
+}
+
+// Calls share one connection, and a call that times out drops it, so the
+// next call dials a new one.
+func TestPoolTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { callTimeout = timeout }(callTimeout)
+	callTimeout = 100 * time.Millisecond
+	addr, _, pool, dials := startPoolTest(t)
+
+	for i := 0; i < 3; i++ {
+		if !pool.call(addr, "PoolTestServer.Fast", &PoolTestArgs{}, &PoolTestReply{}) {
+			t.Fatalf("call %v failed", i)
+		}
+	}
+	if n := dials(); n != 1 {
+		t.Fatalf("dialed %v connections for 3 calls, want 1", n)
+	}
+
+	start := time.Now()
+	if pool.call(addr, "PoolTestServer.Slow", &PoolTestArgs{}, &PoolTestReply{}) {
+		t.Fatalf("a call that never returns succeeded")
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("a call that never returns failed after %v, want %v", took, callTimeout)
+	}
+
+	var reply PoolTestReply
+	if !pool.call(addr, "PoolTestServer.Fast", &PoolTestArgs{}, &reply) || reply.Err != OK {
+		t.Fatalf("call after a timeout failed")
+	}
+	if n := dials(); n != 2 {
+		t.Fatalf("dialed %v connections, want a second after the timeout", n)
+	}
+}
+
+// A connection the server closed is redialed, and the call goes through.
+func TestPoolRedial(t *testing.T) {
+	addr, tl, pool, dials := startPoolTest(t)
+	if !pool.call(addr, "PoolTestServer.Fast", &PoolTestArgs{}, &PoolTestReply{}) {
+		t.Fatalf("first call failed")
+	}
+
+	// Close the server's end of every connection, but keep listening.
+	tl.mu.Lock()
+	var conns []net.Conn
+	for conn := range tl.conns {
+		conns = append(conns, conn)
+	}
+	tl.mu.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+	// Let the client notice.
+	time.Sleep(100 * time.Millisecond)
+
+	if !pool.call(addr, "PoolTestServer.Fast", &PoolTestArgs{}, &PoolTestReply{}) {
+		t.Fatalf("call over a closed connection wasn't redialed")
+	}
+	if n := dials(); n != 2 {
+		t.Fatalf("dialed %v connections, want 2", n)
+	}
+}
@@ -0,0 +1,83 @@
+package lockservice
+
+//
+// A Scheduler runs a node's goroutines and owns its notion of time and
+// randomness. Paxos and LockService never use the go statement, time or
+// math/rand directly, and never block on anything but a Cond from their
+// Scheduler or an RPC, so the same code can run for real or under a
+// deterministic Simulation.
+//
+
+import "context"
+import "math/rand"
+import "sync"
+import "time"
+
+type Scheduler interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	Go(f func())
+	AfterFunc(d time.Duration, f func()) Timer     // Runs f as a new goroutine once d has passed.
+	AfterDone(ctx context.Context, f func()) Timer // Runs f as a new goroutine once ctx is done.
+	NewCond(l sync.Locker) Cond
+	Int63n(n int64) int64 // A random number in [0, n).
+	Float64() float64     // A random number in [0.0, 1.0).
+}
+
+// A timer made by AfterFunc or AfterDone, as in time.Timer.
+type Timer interface {
+	Stop() bool // Keeps f from running. Returns false if it already has.
+}
+
+// A condition variable, as in sync.Cond.
+type Cond interface {
+	Wait()
+	Signal()
+	Broadcast()
+}
+
+// Schedules with real goroutines and the wall clock.
+type realScheduler struct{}
+
+func MakeRealScheduler() Scheduler {
+	return realScheduler{}
+}
+
+func (realScheduler) Now() time.Time {
+	return time.Now()
+}
+
+func (realScheduler) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (realScheduler) Go(f func()) {
+	go f()
+}
+
+func (realScheduler) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+func (realScheduler) AfterDone(ctx context.Context, f func()) Timer {
+	return stopFunc(context.AfterFunc(ctx, f))
+}
+
+// The stop function returned by context.AfterFunc, as a Timer.
+type stopFunc func() bool
+
+func (stop stopFunc) Stop() bool {
+	return stop()
+}
+
+func (realScheduler) NewCond(l sync.Locker) Cond {
+	return sync.NewCond(l)
+}
+
+func (realScheduler) Int63n(n int64) int64 {
+	return rand.Int63n(n)
+}
+
+func (realScheduler) Float64() float64 {
+	return rand.Float64()
+}
@@ -0,0 +1,112 @@
+package lockservice
+
+//
+// Client sessions, as in Chubby.
+//
+// A client opens a session with a timeout and then sends KeepAlives more
+// often than that. Opening, keepalives and closing are all ops in the log,
+// and so is the end of a session that times out: like a lease, every
+// replica times the session from when it committed the last KeepAlive and
+// proposes an ExpireSession once it has run out. Committing the end of a
+// session releases every lock the client holds and takes it out of every
+// line it waits in, all in one instance, and wakes the clients that were
+// handed those locks.
+//
+
+import "sort"
+import "time"
+
+type Session struct {
+	Timeout  time.Duration
+	Instance int // The instance that opened the session or last kept it alive.
+}
+
+// RPC Handler: Open a session for the client.
+func (ls *LockService) OpenSession(args *SessionArgs, reply *SessionReply) error {
+	op := Op{OpType: OpenSession, Client: args.Client, Lease: args.Timeout, Seq: args.Seq, Acked: args.Acked}
+	reply.Err = ls.enqueueRequest(op)
+	return nil
+}
+
+// RPC Handler: Keep the client's session alive.
+func (ls *LockService) KeepAlive(args *SessionArgs, reply *SessionReply) error {
+	op := Op{OpType: KeepAlive, Client: args.Client, Seq: args.Seq, Acked: args.Acked}
+	reply.Err = ls.enqueueRequest(op)
+	return nil
+}
+
+// RPC Handler: End the client's session, releasing its locks.
+func (ls *LockService) CloseSession(args *SessionArgs, reply *SessionReply) error {
+	op := Op{OpType: CloseSession, Client: args.Client, Seq: args.Seq, Acked: args.Acked}
+	reply.Err = ls.enqueueRequest(op)
+	return nil
+}
+
+// Applies a session op committed in instance ls.max.
+// Precondition: ls.mu is locked.
+func (ls *LockService) applySession(op Op) Err {
+	session, open := ls.sessions[op.Client]
+
+	if op.OpType == OpenSession {
+		if !open {
+			ls.sessions[op.Client] = Session{op.Lease, ls.max}
+			ls.keptAlive[op.Client] = ls.sched.Now()
+		}
+		return OK
+	}
+
+	if !open {
+		return SessionExpired
+	}
+
+	if op.OpType == KeepAlive {
+		ls.sessions[op.Client] = Session{session.Timeout, ls.max}
+		ls.keptAlive[op.Client] = ls.sched.Now()
+		return OK
+	}
+
+	if op.OpType == ExpireSession && session.Instance != op.Instance {
+		// The session was kept alive before it expired.
+		return OK
+	}
+	ls.endSession(op.Client)
+	return OK
+}
+
+// Ends the session of client, releasing every lock it holds and taking it
+// out of every line it waits in.
+// Precondition: ls.mu is locked.
+func (ls *LockService) endSession(client int) {
+	delete(ls.sessions, client)
+	delete(ls.keptAlive, client)
+	delete(ls.tables, client)
+
+	// Withdrawing can hand locks on, so every replica must do it in the
+	// same order.
+	var waiting []string
+	for lock, waiters := range ls.waiters {
+		if isWaiting(waiters, client) {
+			waiting = append(waiting, lock)
+		}
+	}
+	sort.Strings(waiting)
+	for _, lock := range waiting {
+		ls.withdraw(lock, client)
+	}
+
+	var held []string
+	for lock, owner := range ls.locks {
+		if owner == client {
+			held = append(held, lock)
+		}
+	}
+	for lock, readers := range ls.readers {
+		if contains(readers, client) {
+			held = append(held, lock)
+		}
+	}
+	sort.Strings(held)
+	for _, lock := range held {
+		ls.release(lock, client)
+	}
+}
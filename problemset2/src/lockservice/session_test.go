@@ -0,0 +1,42 @@
+package lockservice
+
+import "testing"
+import "time"
+
+func TestSessionExpires(t *testing.T) {
+	sim, _, services := makeSimCluster(7, 3)
+	holder := sim.MakeLockClient("n0", "n1", "n2")
+	waiter := sim.MakeLockClient("n1", "n2", "n0")
+
+	begin := sim.Now()
+	var waited time.Duration
+	var openErr, holderErr, waiterErr, afterErr Err
+	sim.Go(func() {
+		if openErr = holder.OpenSession(3 * time.Second); openErr != OK {
+			return
+		}
+		_, holderErr = holder.Lock("/s")
+		// The holder's keepalives stop reaching the cluster.
+		sim.Network().Isolate("client-n0")
+		sim.Sleep(10 * time.Second)
+		sim.Network().HealAll()
+		_, afterErr = holder.Lock("/s2")
+	})
+	sim.Go(func() {
+		sim.Sleep(1 * time.Second)
+		_, waiterErr = waiter.Lock("/s")
+		waited = sim.Now().Sub(begin)
+	})
+	sim.Run(30 * time.Second)
+
+	if openErr != OK || holderErr != OK || waiterErr != OK {
+		t.Fatalf("OpenSession = %v, holder's Lock = %v, waiter's Lock = %v, want OK", openErr, holderErr, waiterErr)
+	}
+	if waited < 3*time.Second || waited > 3*time.Second+expiryGrace+time.Second {
+		t.Fatalf("waiter got the lock after %v, want soon after the 3s session ran out", waited)
+	}
+	if afterErr != SessionExpired {
+		t.Fatalf("holder's Lock after its session ended = %v, want %v", afterErr, SessionExpired)
+	}
+	checkReplicasAgree(t, services)
+}
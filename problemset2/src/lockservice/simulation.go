@@ -0,0 +1,480 @@
+package lockservice
+
+//
+// Deterministic simulation of a whole LockService cluster in one process.
+//
+// A Simulation is a Scheduler and a Transport. Every goroutine of every
+// simulated node is a task, and exactly one task runs at a time. When the
+// running task blocks (sleeping, waiting on a Cond, or waiting for an RPC
+// reply) the simulation picks the next task to run at random from those
+// that are ready. When no task is ready, the virtual clock jumps to the
+// next event: a timer firing, or an RPC request or reply arriving after a
+// random network delay. All of the randomness comes from one seed, so a
+// run that fails replays exactly from its seed.
+//
+// sim := MakeSimulation(seed)
+// for i := range servers {
+//   sim.MakeLockService(servers, i)
+// }
+// lc := sim.MakeLockClient(servers...)
+// sim.Go(func() { lc.Lock("/a") })
+// sim.Run(10 * time.Second)  -- run until quiet or 10s of virtual time pass
+// sim.Network().Isolate(servers[0])
+// sim.Run(10 * time.Second)
+//
+// Code running under a simulation must only block through the Scheduler
+// and Transport, must not hold a mutex while it does, and must not let
+// map iteration order decide what it schedules.
+//
+
+import "bytes"
+import "context"
+import "container/heap"
+import "encoding/gob"
+import "fmt"
+import "math/rand"
+import "reflect"
+import "strings"
+import "sync"
+import "time"
+
+type Simulation struct {
+	mu      sync.Mutex
+	seed    int64
+	rand    *rand.Rand
+	now     time.Time
+	limit   time.Time     // Run() stops when the clock reaches limit.
+	events  eventQueue    // Pending timers and message deliveries.
+	nextId  int           // Orders events scheduled for the same time.
+	ready   []*simTask    // Tasks that can run.
+	running *simTask      // The task that is running, if any.
+	idle    chan struct{} // Signalled when Run() should return.
+
+	servers    map[string]*simServer // Listening nodes, by address.
+	minLatency time.Duration
+	maxLatency time.Duration
+	network    *FaultyNetwork
+}
+
+type simTask struct {
+	wake chan struct{}
+}
+
+type simEvent struct {
+	at   time.Time
+	id   int
+	fire func() // Called with sim.mu locked.
+}
+
+type eventQueue []*simEvent
+
+func (eq eventQueue) Len() int { return len(eq) }
+func (eq eventQueue) Less(i, j int) bool {
+	if eq[i].at.Equal(eq[j].at) {
+		return eq[i].id < eq[j].id
+	}
+	return eq[i].at.Before(eq[j].at)
+}
+func (eq eventQueue) Swap(i, j int)       { eq[i], eq[j] = eq[j], eq[i] }
+func (eq *eventQueue) Push(x interface{}) { *eq = append(*eq, x.(*simEvent)) }
+func (eq *eventQueue) Pop() interface{} {
+	old := *eq
+	event := old[len(old)-1]
+	*eq = old[:len(old)-1]
+	return event
+}
+
+func MakeSimulation(seed int64) *Simulation {
+	sim := new(Simulation)
+	sim.seed = seed
+	sim.rand = rand.New(rand.NewSource(seed))
+	sim.now = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	sim.idle = make(chan struct{}, 1)
+	sim.servers = make(map[string]*simServer)
+	sim.minLatency = 1 * time.Millisecond
+	sim.maxLatency = 10 * time.Millisecond
+	sim.network = makeFaultyNetwork(sim, sim)
+	return sim
+}
+
+func (sim *Simulation) Seed() int64 {
+	return sim.seed
+}
+
+// Sets the range that random network delays are drawn from.
+func (sim *Simulation) SetLatency(min time.Duration, max time.Duration) {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	sim.minLatency = min
+	sim.maxLatency = max
+}
+
+// The simulated network, for injecting faults. Nodes made with
+// MakeLockService(), JoinLockService() and MakeLockClient() send their RPCs
+// through it.
+func (sim *Simulation) Network() *FaultyNetwork {
+	return sim.network
+}
+
+// Creates the simulated LockService for servers[me]. It keeps no state on
+// disk.
+func (sim *Simulation) MakeLockService(servers []string, me int) *LockService {
+	return MakeLockService(servers, me, "", sim.network.Transport(servers[me]), sim)
+}
+
+// Creates a simulated LockService for me that joins the cluster member
+// belongs to. It keeps no state on disk. Must be called from a simulation
+// task.
+func (sim *Simulation) JoinLockService(member string, me string) *LockService {
+	return JoinLockService(member, me, "", sim.network.Transport(me), sim)
+}
+
+// Creates a simulated client of servers, which tries servers[0] first.
+// Its calls must be made from a simulation task.
+func (sim *Simulation) MakeLockClient(servers ...string) *LockClient {
+	lc := MakeLockClient(servers, sim.network.Transport(fmt.Sprintf("client-%v", servers[0])))
+	lc.sched = sim
+	lc.ClientId = int(sim.Int63n(1 << 62))
+	return lc
+}
+
+// Runs tasks until none can make progress or d of virtual time has passed.
+// Must not be called from a task.
+func (sim *Simulation) Run(d time.Duration) {
+	sim.mu.Lock()
+	if sim.running != nil {
+		sim.mu.Unlock()
+		panic("Simulation.Run() called from a simulation task")
+	}
+	sim.limit = sim.now.Add(d)
+	sim.schedule()
+	sim.mu.Unlock()
+	<-sim.idle
+}
+
+// Hands the CPU to the next task. If no task is ready, advances the clock
+// to the next event. If there is nothing left to do before the limit,
+// returns control to Run().
+// Precondition: sim.mu is locked and no task is running.
+func (sim *Simulation) schedule() {
+	for {
+		if len(sim.ready) > 0 {
+			i := sim.rand.Intn(len(sim.ready))
+			task := sim.ready[i]
+			sim.ready = append(sim.ready[:i], sim.ready[i+1:]...)
+			sim.running = task
+			task.wake <- struct{}{}
+			return
+		}
+		if len(sim.events) == 0 || sim.events[0].at.After(sim.limit) {
+			sim.now = sim.limit
+			sim.idle <- struct{}{}
+			return
+		}
+		event := heap.Pop(&sim.events).(*simEvent)
+		sim.now = event.at
+		event.fire()
+	}
+}
+
+// Returns the running task. Panics if the caller isn't one.
+// Precondition: sim.mu is locked.
+func (sim *Simulation) current() *simTask {
+	if sim.running == nil {
+		panic("simulation: blocking call made outside of a simulation task")
+	}
+	return sim.running
+}
+
+// Blocks the running task until something makes it ready again.
+// Precondition: sim.mu is locked by the running task. It is unlocked on
+// return.
+func (sim *Simulation) block(task *simTask) {
+	sim.running = nil
+	sim.schedule()
+	sim.mu.Unlock()
+	<-task.wake
+}
+
+// Calls fire once d of virtual time has passed.
+// Precondition: sim.mu is locked.
+func (sim *Simulation) after(d time.Duration, fire func()) {
+	sim.nextId++
+	heap.Push(&sim.events, &simEvent{sim.now.Add(d), sim.nextId, fire})
+}
+
+// Returns a random network delay.
+// Precondition: sim.mu is locked.
+func (sim *Simulation) latency() time.Duration {
+	spread := int64(sim.maxLatency - sim.minLatency)
+	if spread <= 0 {
+		return sim.minLatency
+	}
+	return sim.minLatency + time.Duration(sim.rand.Int63n(spread))
+}
+
+//
+// Scheduler implementation.
+//
+
+func (sim *Simulation) Now() time.Time {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	return sim.now
+}
+
+func (sim *Simulation) Sleep(d time.Duration) {
+	sim.mu.Lock()
+	task := sim.current()
+	sim.after(d, func() {
+		sim.ready = append(sim.ready, task)
+	})
+	sim.block(task)
+}
+
+func (sim *Simulation) Go(f func()) {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	sim.spawn(f)
+}
+
+// Creates a ready task that runs f.
+// Precondition: sim.mu is locked.
+func (sim *Simulation) spawn(f func()) {
+	task := &simTask{make(chan struct{}, 1)}
+	sim.ready = append(sim.ready, task)
+
+	go func() {
+		<-task.wake
+		f()
+		sim.mu.Lock()
+		sim.running = nil
+		sim.schedule()
+		sim.mu.Unlock()
+	}()
+}
+
+func (sim *Simulation) AfterFunc(d time.Duration, f func()) Timer {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	if d < 0 {
+		d = 0
+	}
+	timer := &simTimer{sim: sim}
+	sim.after(d, func() {
+		if !timer.stopped {
+			timer.fired = true
+			sim.spawn(f)
+		}
+	})
+	return timer
+}
+
+// How often AfterDone checks whether its context is done, in virtual time.
+// A context isn't done through the simulation, so it can't wake a task.
+const contextCheckInterval = 10 * time.Millisecond
+
+func (sim *Simulation) AfterDone(ctx context.Context, f func()) Timer {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	timer := &simTimer{sim: sim}
+	var check func()
+	check = func() {
+		if timer.stopped {
+			return
+		}
+		if ctx.Err() != nil {
+			timer.fired = true
+			sim.spawn(f)
+			return
+		}
+		sim.after(contextCheckInterval, check)
+	}
+	check()
+	return timer
+}
+
+func (sim *Simulation) NewCond(l sync.Locker) Cond {
+	return &simCond{sim, l, nil}
+}
+
+func (sim *Simulation) Int63n(n int64) int64 {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	return sim.rand.Int63n(n)
+}
+
+func (sim *Simulation) Float64() float64 {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	return sim.rand.Float64()
+}
+
+type simTimer struct {
+	sim     *Simulation
+	stopped bool // Protected by sim.mu.
+	fired   bool // Protected by sim.mu.
+}
+
+func (st *simTimer) Stop() bool {
+	st.sim.mu.Lock()
+	defer st.sim.mu.Unlock()
+	if st.stopped || st.fired {
+		return false
+	}
+	st.stopped = true
+	return true
+}
+
+type simCond struct {
+	sim     *Simulation
+	l       sync.Locker
+	waiters []*simTask // Protected by sim.mu.
+}
+
+func (sc *simCond) Wait() {
+	sc.sim.mu.Lock()
+	task := sc.sim.current()
+	sc.waiters = append(sc.waiters, task)
+	sc.l.Unlock()
+	sc.sim.block(task)
+	sc.l.Lock()
+}
+
+func (sc *simCond) Signal() {
+	sc.sim.mu.Lock()
+	defer sc.sim.mu.Unlock()
+	if len(sc.waiters) > 0 {
+		sc.sim.ready = append(sc.sim.ready, sc.waiters[0])
+		sc.waiters = sc.waiters[1:]
+	}
+}
+
+func (sc *simCond) Broadcast() {
+	sc.sim.mu.Lock()
+	defer sc.sim.mu.Unlock()
+	sc.sim.ready = append(sc.sim.ready, sc.waiters...)
+	sc.waiters = nil
+}
+
+//
+// Transport implementation. Requests and replies are copied with gob, as
+// they would be on a real network, and handlers run as new tasks.
+//
+
+type simServer struct {
+	sim       *Simulation
+	addr      string
+	receivers map[string]interface{} // Registered receivers, by type name.
+}
+
+func (sim *Simulation) Serve(addr string) (Server, error) {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	if _, exists := sim.servers[addr]; exists {
+		return nil, fmt.Errorf("simulation: %v already in use", addr)
+	}
+	server := &simServer{sim, addr, make(map[string]interface{})}
+	sim.servers[addr] = server
+	return server, nil
+}
+
+func (ss *simServer) Register(rcvr interface{}) error {
+	ss.sim.mu.Lock()
+	defer ss.sim.mu.Unlock()
+	ss.receivers[reflect.Indirect(reflect.ValueOf(rcvr)).Type().Name()] = rcvr
+	return nil
+}
+
+func (ss *simServer) Close() error {
+	ss.sim.mu.Lock()
+	defer ss.sim.mu.Unlock()
+	if ss.sim.servers[ss.addr] == ss {
+		delete(ss.sim.servers, ss.addr)
+	}
+	return nil
+}
+
+// Returns the handler for rpcname on the server at addr, if it is
+// listening.
+// Precondition: sim.mu is locked.
+func (sim *Simulation) handler(addr string, rpcname string) (reflect.Value, bool) {
+	server, ok := sim.servers[addr]
+	if !ok {
+		return reflect.Value{}, false
+	}
+	dot := strings.LastIndex(rpcname, ".")
+	if dot < 0 {
+		return reflect.Value{}, false
+	}
+	rcvr, ok := server.receivers[rpcname[:dot]]
+	if !ok {
+		return reflect.Value{}, false
+	}
+	method := reflect.ValueOf(rcvr).MethodByName(rpcname[dot+1:])
+	return method, method.IsValid()
+}
+
+func (sim *Simulation) Call(srv string, rpcname string, args interface{}, reply interface{}) bool {
+	request, err := gobEncode(args)
+	if err != nil {
+		panic(fmt.Sprintf("simulation: encoding %v args: %v", rpcname, err))
+	}
+
+	sim.mu.Lock()
+	caller := sim.current()
+	ok := false
+	done := func(response []byte) {
+		if response != nil {
+			ok = gobDecode(response, reply) == nil
+		}
+		sim.ready = append(sim.ready, caller)
+	}
+
+	// Deliver the request after a delay, and handle it in a new task.
+	sim.after(sim.latency(), func() {
+		method, listening := sim.handler(srv, rpcname)
+		if !listening {
+			sim.after(sim.latency(), func() { done(nil) })
+			return
+		}
+		sim.spawn(func() {
+			response := invoke(method, request)
+			sim.mu.Lock()
+			sim.after(sim.latency(), func() { done(response) })
+			sim.mu.Unlock()
+		})
+	})
+
+	sim.block(caller)
+	return ok
+}
+
+// Calls an RPC handler with gob encoded args, and returns the gob encoded
+// reply, or nil if the handler failed.
+func invoke(method reflect.Value, request []byte) []byte {
+	args := reflect.New(method.Type().In(0).Elem())
+	if gobDecode(request, args.Interface()) != nil {
+		return nil
+	}
+	reply := reflect.New(method.Type().In(1).Elem())
+	result := method.Call([]reflect.Value{args, reply})
+	if err, _ := result[0].Interface().(error); err != nil {
+		return nil
+	}
+	response, err := gobEncode(reply.Interface())
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+func gobEncode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func gobDecode(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
@@ -0,0 +1,102 @@
+package lockservice
+
+import "fmt"
+import "reflect"
+import "testing"
+import "time"
+
+// Makes a simulated cluster of n LockServices, named n0, n1, ...
+func makeSimCluster(seed int64, n int) (*Simulation, []string, []*LockService) {
+	sim := MakeSimulation(seed)
+	servers := make([]string, n)
+	for i := range servers {
+		servers[i] = fmt.Sprintf("n%v", i)
+	}
+	services := make([]*LockService, n)
+	for i := range servers {
+		services[i] = sim.MakeLockService(servers, i)
+	}
+	return sim, servers, services
+}
+
+// Returns a copy of the replicated state of ls.
+func replicaState(ls *LockService) *Snapshot {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return ls.makeSnapshot()
+}
+
+// Fails t unless every LockService has committed the same instances to the
+// same state.
+func checkReplicasAgree(t *testing.T, services []*LockService) {
+	t.Helper()
+	want := replicaState(services[0])
+	for i, ls := range services[1:] {
+		if got := replicaState(ls); !reflect.DeepEqual(got, want) {
+			t.Fatalf("replica %v has state %+v after instance %v, but replica 0 has %+v after instance %v",
+				i+1, got, got.Max, want, want.Max)
+		}
+	}
+}
+
+// Returns the batches of ops ls has committed that Paxos still remembers,
+// by instance.
+func committedLog(ls *LockService) map[int][]Op {
+	log := make(map[int][]Op)
+	ls.mu.Lock()
+	max := ls.max
+	ls.mu.Unlock()
+	for instance := ls.px.Min(); instance <= max; instance++ {
+		if decided, ops, err := ls.px.Status(instance); decided {
+			log[instance], _ = decodedOps(ops, err)
+		}
+	}
+	return log
+}
+
+// Runs clients contending for a few locks through a lossy network, and
+// returns what they saw and what every replica committed.
+func runContention(seed int64) ([]string, []map[int][]Op) {
+	sim, servers, services := makeSimCluster(seed, 3)
+	sim.Network().SetDrop("n2", "n0", 0.2)
+
+	var seen []string
+	for c := 0; c < 3; c++ {
+		lc := sim.MakeLockClient(servers[c:]...)
+		c := c
+		sim.Go(func() {
+			for i := 0; i < 5; i++ {
+				lock := fmt.Sprintf("/a/%v", i%2)
+				token, err := lc.Lock(lock)
+				seen = append(seen, fmt.Sprintf("%v: client %v locked %v: %v %v", sim.Now(), c, lock, err, token))
+				err = lc.Unlock(lock)
+				seen = append(seen, fmt.Sprintf("%v: client %v unlocked %v: %v", sim.Now(), c, lock, err))
+			}
+		})
+	}
+	sim.Run(60 * time.Second)
+
+	logs := make([]map[int][]Op, len(services))
+	for i, ls := range services {
+		logs[i] = committedLog(ls)
+	}
+	return seen, logs
+}
+
+func TestSameSeedSameRun(t *testing.T) {
+	seen, logs := runContention(7)
+	if len(seen) != 30 {
+		t.Fatalf("clients finished %v of 30 calls: %v", len(seen), seen)
+	}
+	if len(logs[0]) == 0 {
+		t.Fatalf("nothing was committed")
+	}
+
+	again, againLogs := runContention(7)
+	if !reflect.DeepEqual(seen, again) {
+		t.Fatalf("clients saw\n%v\nthe first time and\n%v\nthe second", seen, again)
+	}
+	if !reflect.DeepEqual(logs, againLogs) {
+		t.Fatalf("replicas committed\n%v\nthe first time and\n%v\nthe second", logs, againLogs)
+	}
+}
@@ -0,0 +1,211 @@
+package lockservice
+
+//
+// Snapshots of the replicated LockService state.
+//
+// Every SnapshotInterval committed instances a LockService copies its lock
+// table into a Snapshot, writes it to disk, and tells Paxos it is Done()
+// with every instance the snapshot covers, so that Paxos can forget them.
+// A restarting LockService loads its last snapshot and only has to replay
+// the instances decided after it.
+//
+// The saved snapshot starts with snapshotMagic and the version of its
+// format, bumped whenever Snapshot changes in a way gob can't decode. A
+// snapshot of a later version than my own is refused.
+//
+
+import "bytes"
+import "encoding/gob"
+import "fmt"
+import "io"
+import "os"
+import "path/filepath"
+import "time"
+
+const SnapshotInterval = 64 // Committed instances between snapshots.
+
+const snapshotFile = "lockservice.snapshot"
+
+const snapshotMagic = "lssnap"
+const snapshotVersion = 1
+
+// The replicated state of a LockService after committing instance Max.
+type Snapshot struct {
+	Max      int
+	Locks    map[string]int      // map lock name -> client id holding it exclusively, if any
+	Readers  map[string][]int    // map lock name -> client ids holding it shared
+	Tokens   map[Hold]int        // map holder -> fencing token of its grant
+	Token    int                 // The fencing token of the latest grant of any lock.
+	Waiters  map[string][]Waiter // map lock name -> clients waiting for it, in order
+	Position int                 // The place in line of the latest client to get in line.
+	Subtrees map[Hold]bool       // holders that also hold everything below their lock
+	Changes  map[string]Change   // map lock name -> last change to its holders
+	Leases   map[Hold]Lease      // map holder -> its lease, if it has one
+	Sessions map[int]Session     // map client id -> its open session
+	Tables   map[int]ClientTable // map client id -> results of its requests
+	Config   Config              // The membership after Max.
+}
+
+// Copies the current state into a new snapshot.
+func (ls *LockService) makeSnapshot() *Snapshot {
+	snapshot := &Snapshot{ls.max, make(map[string]int), make(map[string][]int), make(map[Hold]int), ls.token,
+		make(map[string][]Waiter), ls.position, make(map[Hold]bool), make(map[string]Change), make(map[Hold]Lease),
+		make(map[int]Session), make(map[int]ClientTable), ls.config}
+	for lock, client := range ls.locks {
+		snapshot.Locks[lock] = client
+	}
+	for lock, readers := range ls.readers {
+		snapshot.Readers[lock] = append([]int(nil), readers...)
+	}
+	for hold, token := range ls.tokens {
+		snapshot.Tokens[hold] = token
+	}
+	for lock, waiters := range ls.waiters {
+		snapshot.Waiters[lock] = append([]Waiter(nil), waiters...)
+	}
+	for hold := range ls.subtrees {
+		snapshot.Subtrees[hold] = true
+	}
+	for lock, change := range ls.changes {
+		snapshot.Changes[lock] = change
+	}
+	for client, table := range ls.tables {
+		snapshot.Tables[client] = table.copy()
+	}
+	for hold, lease := range ls.leases {
+		snapshot.Leases[hold] = lease
+	}
+	for client, session := range ls.sessions {
+		snapshot.Sessions[client] = session
+	}
+	return snapshot
+}
+
+// Replaces the current state with the state in snapshot.
+// Precondition: ls.mu is locked.
+func (ls *LockService) installSnapshot(snapshot *Snapshot) {
+	ls.max = snapshot.Max
+	ls.locks = make(map[string]int)
+	for lock, client := range snapshot.Locks {
+		if client != Unlocked {
+			ls.locks[lock] = client
+		}
+	}
+	ls.readers = make(map[string][]int)
+	for lock, readers := range snapshot.Readers {
+		ls.readers[lock] = append([]int(nil), readers...)
+	}
+	ls.tokens = make(map[Hold]int)
+	for hold, token := range snapshot.Tokens {
+		ls.tokens[hold] = token
+	}
+	ls.token = snapshot.Token
+	ls.waiters = make(map[string][]Waiter)
+	for lock, waiters := range snapshot.Waiters {
+		ls.waiters[lock] = append([]Waiter(nil), waiters...)
+	}
+	ls.position = snapshot.Position
+	ls.subtrees = make(map[Hold]bool)
+	for hold := range snapshot.Subtrees {
+		ls.subtrees[hold] = true
+	}
+	ls.changes = make(map[string]Change)
+	for lock, change := range snapshot.Changes {
+		ls.changes[lock] = change
+	}
+	ls.tables = make(map[int]ClientTable)
+	for client, table := range snapshot.Tables {
+		ls.tables[client] = table.copy()
+	}
+	// I don't know when the leases and sessions were last renewed, so I
+	// time them from now.
+	ls.leases = make(map[Hold]Lease)
+	ls.renewed = make(map[Hold]time.Time)
+	for hold, lease := range snapshot.Leases {
+		ls.leases[hold] = lease
+		ls.renewed[hold] = ls.sched.Now()
+	}
+	ls.sessions = make(map[int]Session)
+	ls.keptAlive = make(map[int]time.Time)
+	for client, session := range snapshot.Sessions {
+		ls.sessions[client] = session
+		ls.keptAlive[client] = ls.sched.Now()
+	}
+	ls.reindex()
+	ls.config = snapshot.Config
+	if ls.px != nil {
+		ls.px.Reconfigure(ls.config)
+	}
+	ls.snapshot = snapshot
+	ls.changed.Broadcast()
+}
+
+// Snapshots the current state, saves it, and lets Paxos forget the
+// instances it covers.
+// Precondition: ls.mu is locked.
+func (ls *LockService) takeSnapshot() {
+	snapshot := ls.makeSnapshot()
+	if ls.dir != "" {
+		if err := writeSnapshot(ls.dir, snapshot); err != nil {
+			// Keep the history in Paxos until a snapshot can be saved.
+			DPrintf("takeSnapshot(): %v\n", err)
+			return
+		}
+	}
+	ls.snapshot = snapshot
+	ls.px.Done(snapshot.Max)
+}
+
+// Atomically replaces the snapshot saved in dir.
+func writeSnapshot(dir string, snapshot *Snapshot) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, snapshotFile)
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append([]byte(snapshotMagic), snapshotVersion)); err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(file).Encode(snapshot); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return err
+	}
+	// Paxos forgets the instances the snapshot covers as soon as I return,
+	// so the rename must be on disk first.
+	return syncDir(dir)
+}
+
+// Reads the snapshot saved in dir. Returns nil if there isn't one.
+func readSnapshot(dir string) (*Snapshot, error) {
+	file, err := os.Open(filepath.Join(dir, snapshotFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	start := make([]byte, len(snapshotMagic)+1)
+	if _, err := io.ReadFull(file, start); err != nil || !bytes.HasPrefix(start, []byte(snapshotMagic)) {
+		return nil, fmt.Errorf("snapshot: %v is not a snapshot", file.Name())
+	}
+	if version := start[len(snapshotMagic)]; version > snapshotVersion {
+		return nil, fmt.Errorf("snapshot: %v", &VersionError{version, snapshotVersion})
+	}
+
+	snapshot := new(Snapshot)
+	if err := gob.NewDecoder(file).Decode(snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
@@ -0,0 +1,108 @@
+package lockservice
+
+//
+// State transfer for a LockService that has fallen behind.
+//
+// Once its peers have snapshotted and forgotten instances that a
+// LockService never committed, it can't learn those decisions through
+// Paxos any more. Instead it asks a peer for that peer's latest snapshot
+// and the decided instances that follow it, installs them, and then goes
+// back to normal agreement.
+//
+
+import "time"
+
+type TransferArgs struct {
+	Max int // The highest instance the caller has committed.
+}
+
+type TransferReply struct {
+	Err      Err
+	Snapshot *Snapshot // The sender's latest snapshot.
+	Start    int       // The instance of Decided[0].
+	Decided  [][]byte  // Decided values of consecutive instances.
+}
+
+// RPC Handler: Send a lagging peer my latest snapshot and the decided
+// instances after it.
+func (ls *LockService) Transfer(args *TransferArgs, reply *TransferReply) error {
+	ls.mu.Lock()
+	snapshot := ls.snapshot
+	ls.mu.Unlock()
+
+	reply.Err = OK
+	reply.Snapshot = snapshot
+	reply.Start = args.Max + 1
+	if snapshot.Max > args.Max {
+		reply.Start = snapshot.Max + 1
+	}
+
+	for instance := reply.Start; ; instance++ {
+		decided, value := ls.px.Paxos.Status(instance)
+		if !decided {
+			break
+		}
+		reply.Decided = append(reply.Decided, value)
+	}
+	return nil
+}
+
+// Fetches the state I missed from the other peers. Called when Paxos
+// reports that my next instance has been forgotten.
+func (ls *LockService) catchUp() {
+	for _, server := range ls.config.Peers {
+		if server == ls.me {
+			continue
+		}
+
+		reply, ok := ls.fetchTransfer(server)
+		if !ok {
+			continue
+		}
+
+		ls.applyTransfer(reply)
+		if !ls.px.Forgotten(ls.max + 1) {
+			return
+		}
+	}
+
+	// Nobody could help; wait before the applier tries again.
+	ls.sched.Sleep(100 * time.Millisecond)
+}
+
+// Asks server for the state after my last committed instance.
+func (ls *LockService) fetchTransfer(server string) (*TransferReply, bool) {
+	args := TransferArgs{ls.max}
+	var reply TransferReply
+	ok := ls.transport.Call(server, "LockService.Transfer", &args, &reply)
+	return &reply, ok && reply.Err == OK
+}
+
+// Installs the state sent by a peer, if it is ahead of mine.
+func (ls *LockService) applyTransfer(reply *TransferReply) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if reply.Snapshot.Max > ls.max {
+		DPrintf("applyTransfer(): installing snapshot at instance %v\n", reply.Snapshot.Max)
+		ls.installSnapshot(reply.Snapshot)
+		if ls.dir != "" {
+			if err := writeSnapshot(ls.dir, reply.Snapshot); err != nil {
+				DPrintf("applyTransfer(): %v\n", err)
+			}
+		}
+		ls.px.Done(ls.max)
+	}
+
+	for i, value := range reply.Decided {
+		instance := reply.Start + i
+		if instance == ls.max+1 {
+			ops, err := decodedOps(ls.px.Decode(value))
+			if err != nil {
+				// The applier stops here too.
+				break
+			}
+			ls.commitOperation(instance, ops)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package lockservice
+
+import "fmt"
+import "testing"
+import "time"
+
+// A peer that joins after the cluster forgot its early instances starts
+// from a snapshot sent with Transfer.
+func TestCatchUpFromSnapshot(t *testing.T) {
+	sim, servers, services := makeSimCluster(8, 3)
+	lc := sim.MakeLockClient(servers...)
+
+	var joined *LockService
+	var heldErr, afterErr Err
+	sim.Go(func() {
+		if _, err := lc.Lock("/held"); err != OK {
+			t.Errorf("Lock(/held) = %v", err)
+			return
+		}
+		for i := 0; i < 2*SnapshotInterval; i++ {
+			lock := fmt.Sprintf("/s/%v", i)
+			lc.Lock(lock)
+			lc.Unlock(lock)
+		}
+
+		joined = sim.JoinLockService("n0", "n3")
+		other := sim.MakeLockClient("n3")
+		_, heldErr = other.TryLock("/held")
+		_, afterErr = other.Lock("/after")
+	})
+	sim.Run(60 * time.Second)
+
+	if joined == nil {
+		t.Fatalf("n3 didn't join")
+	}
+	if min := services[0].px.Min(); min < SnapshotInterval {
+		t.Fatalf("the cluster still remembers every instance from %v", min)
+	}
+	if joined.snapshot == nil || joined.snapshot.Max < SnapshotInterval {
+		t.Fatalf("n3 started from snapshot %+v, want one the cluster took", joined.snapshot)
+	}
+	if heldErr != Locked || afterErr != OK {
+		t.Fatalf("through n3, TryLock(/held) = %v and Lock(/after) = %v, want %v and %v",
+			heldErr, afterErr, Locked, OK)
+	}
+	checkReplicasAgree(t, append(services, joined))
+}
@@ -0,0 +1,233 @@
+package lockservice
+
+//
+// Transports carry RPCs between Paxos peers, and between LockClients and
+// LockServices. Each node gets its own rpc.Server from Transport.Serve, so
+// several nodes can live in one process. Calls to a server share one
+// pooled connection (see pool.go).
+//
+// MakeTCPTransport()    -- RPC over HTTP over TCP, addresses are host:port
+// MakeUnixTransport()   -- RPC over HTTP over Unix domain sockets,
+//                          addresses are socket paths
+// MakeMemoryTransport() -- an in-process network for tests, addresses are
+//                          arbitrary names
+//
+
+import "errors"
+import "fmt"
+import "net"
+import "net/http"
+import "net/rpc"
+import "os"
+import "sync"
+
+type Transport interface {
+	// Call() sends an RPC to the rpcname handler on server srv
+	// with arguments args, waits for the reply, and leaves the
+	// reply in reply. the reply argument should be a pointer
+	// to a reply structure.
+	//
+	// the return value is true if the server responded, and false
+	// if Call() was not able to contact the server. in particular,
+	// the reply's contents are only valid if Call() returned true.
+	Call(srv string, rpcname string, args interface{}, reply interface{}) bool
+
+	// Serve() starts accepting RPCs at addr. Handlers are added to the
+	// returned Server with Register().
+	Serve(addr string) (Server, error)
+}
+
+type Server interface {
+	Register(rcvr interface{}) error
+	Close() error
+}
+
+// A Server that dispatches connections from a listener to an rpc.Server.
+type rpcServer struct {
+	server   *rpc.Server
+	listener net.Listener
+}
+
+func (rs *rpcServer) Register(rcvr interface{}) error {
+	return rs.server.Register(rcvr)
+}
+
+func (rs *rpcServer) Close() error {
+	return rs.listener.Close()
+}
+
+// Serves RPCs tunneled through HTTP CONNECT, as rpc.DialHTTP expects.
+func serveHTTP(listener net.Listener) *rpcServer {
+	tracked := trackConns(listener)
+	rs := &rpcServer{rpc.NewServer(), tracked}
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, rs.server)
+	go http.Serve(tracked, mux)
+	return rs
+}
+
+// Serves RPCs directly on each connection.
+func serveConns(listener net.Listener) *rpcServer {
+	tracked := trackConns(listener)
+	rs := &rpcServer{rpc.NewServer(), tracked}
+	go func() {
+		for {
+			conn, err := tracked.Accept()
+			if err != nil {
+				return
+			}
+			go rs.server.ServeConn(conn)
+		}
+	}()
+	return rs
+}
+
+//
+// TCP and Unix domain socket transports.
+//
+
+type netTransport struct {
+	network string // "tcp" or "unix"
+	pool    *connPool
+}
+
+func makeNetTransport(network string) *netTransport {
+	nt := &netTransport{network: network}
+	nt.pool = makeConnPool(func(srv string) (*rpc.Client, error) {
+		return dialHTTP(nt.network, srv)
+	})
+	return nt
+}
+
+func MakeTCPTransport() Transport {
+	return makeNetTransport("tcp")
+}
+
+func MakeUnixTransport() Transport {
+	return makeNetTransport("unix")
+}
+
+// Returns the network transport with the given name, "tcp" or "unix".
+func MakeNetTransport(name string) (Transport, error) {
+	switch name {
+	case "tcp":
+		return MakeTCPTransport(), nil
+	case "unix":
+		return MakeUnixTransport(), nil
+	}
+	return nil, fmt.Errorf("unknown transport %q", name)
+}
+
+func (nt *netTransport) Call(srv string, rpcname string, args interface{}, reply interface{}) bool {
+	return nt.pool.call(srv, rpcname, args, reply)
+}
+
+func (nt *netTransport) Serve(addr string) (Server, error) {
+	if nt.network == "unix" {
+		// Remove the socket left behind by a previous run.
+		os.Remove(addr)
+	}
+	listener, err := net.Listen(nt.network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return serveHTTP(listener), nil
+}
+
+//
+// In-memory transport. Connections are net.Pipes handed to the server's
+// listener over a channel.
+//
+
+type memoryTransport struct {
+	mu        sync.Mutex
+	listeners map[string]*memoryListener
+	pool      *connPool
+}
+
+type memoryListener struct {
+	transport *memoryTransport
+	addr      string
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type memoryAddr string
+
+func (ma memoryAddr) Network() string { return "memory" }
+func (ma memoryAddr) String() string  { return string(ma) }
+
+var errListenerClosed = errors.New("memory transport: listener closed")
+
+// Makes a new in-memory network. Only nodes that share the Transport can
+// reach each other.
+func MakeMemoryTransport() Transport {
+	mt := new(memoryTransport)
+	mt.listeners = make(map[string]*memoryListener)
+	mt.pool = makeConnPool(mt.dial)
+	return mt
+}
+
+func (mt *memoryTransport) Call(srv string, rpcname string, args interface{}, reply interface{}) bool {
+	return mt.pool.call(srv, rpcname, args, reply)
+}
+
+// Connects to the server listening at srv.
+func (mt *memoryTransport) dial(srv string) (*rpc.Client, error) {
+	mt.mu.Lock()
+	listener := mt.listeners[srv]
+	mt.mu.Unlock()
+	if listener == nil {
+		return nil, fmt.Errorf("memory transport: nothing listening at %v", srv)
+	}
+
+	client, server := net.Pipe()
+	select {
+	case listener.conns <- server:
+	case <-listener.closed:
+		client.Close()
+		server.Close()
+		return nil, errListenerClosed
+	}
+	return rpc.NewClient(client), nil
+}
+
+func (mt *memoryTransport) Serve(addr string) (Server, error) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	if _, exists := mt.listeners[addr]; exists {
+		return nil, fmt.Errorf("memory transport: %v already in use", addr)
+	}
+	listener := &memoryListener{
+		transport: mt,
+		addr:      addr,
+		conns:     make(chan net.Conn),
+		closed:    make(chan struct{}),
+	}
+	mt.listeners[addr] = listener
+	return serveConns(listener), nil
+}
+
+func (ml *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ml.conns:
+		return conn, nil
+	case <-ml.closed:
+		return nil, errListenerClosed
+	}
+}
+
+func (ml *memoryListener) Close() error {
+	ml.closeOnce.Do(func() {
+		ml.transport.mu.Lock()
+		delete(ml.transport.listeners, ml.addr)
+		ml.transport.mu.Unlock()
+		close(ml.closed)
+	})
+	return nil
+}
+
+func (ml *memoryListener) Addr() net.Addr {
+	return memoryAddr(ml.addr)
+}
@@ -0,0 +1,214 @@
+package lockservice
+
+//
+// Write-ahead log for the durable state of a Paxos peer.
+//
+// Every change to an acceptor's InstanceInfo, to the promise it made to a
+// leader, or to the per-peer done map is appended to the log and synced to
+// disk before the change becomes visible to other peers. On restart
+// MakePaxos replays the log, so a peer never breaks a promise or forgets an
+// accept it made before crashing.
+//
+// Each record is gob encoded on its own and prefixed with its length, so a
+// record that was only partially written when the peer crashed can be
+// detected and discarded on replay.
+//
+// The log starts with walMagic and the version of its format, which is
+// bumped whenever a record changes in a way gob can't decode. Replay
+// refuses a log of a later version than its own.
+//
+
+import "bytes"
+import "encoding/binary"
+import "encoding/gob"
+import "fmt"
+import "io"
+import "os"
+import "path/filepath"
+
+const walFile = "paxos.wal"
+
+const walMagic = "pxwal"
+const walVersion = 1
+
+// Record types.
+const (
+	walInstance = "Instance" // The InstanceInfo of an instance changed.
+	walDone     = "Done"     // The done value of a peer increased.
+	walPromise  = "Promise"  // The acceptor promised a leader's ballot.
+)
+
+type walRecord struct {
+	Type     string
+	Instance int // The instance changed, or the first instance promised.
+	Info     InstanceInfo
+	Peer     string
+	Done     int
+	Proposal int // The ballot promised.
+}
+
+type wal struct {
+	dir  string
+	file *os.File
+	size int64 // Bytes written since the log was last rewritten.
+}
+
+// Opens (or creates) the write-ahead log in dir.
+func openWal(dir string) (*wal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, walFile)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// Make sure a newly created log is still there after a crash.
+	if err := syncDir(dir); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &wal{dir, file, 0}, nil
+}
+
+// Returns the start of a log in the current format.
+func walHeader() []byte {
+	return append([]byte(walMagic), walVersion)
+}
+
+// Reads every complete record in the log and passes it to apply, in the
+// order the records were written. A partial record at the end of the log
+// (from a crash during append) is truncated away.
+func (w *wal) replay(apply func(*walRecord)) error {
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	header := walHeader()
+	start := make([]byte, len(header))
+	n, _ := io.ReadFull(w.file, start)
+	if n < len(header) && bytes.Equal(start[:n], header[:n]) {
+		// The log was just created, and its header isn't all on disk.
+		return w.rewrite(nil)
+	}
+	if !bytes.Equal(start[:len(walMagic)], header[:len(walMagic)]) {
+		return fmt.Errorf("wal: %v is not a log", w.file.Name())
+	}
+	if version := start[len(walMagic)]; version > walVersion {
+		return fmt.Errorf("wal: %v", &VersionError{version, walVersion})
+	}
+
+	offset := int64(len(header))
+	for {
+		data := w.next()
+		if data == nil {
+			break
+		}
+		var record walRecord
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&record); err != nil {
+			break
+		}
+		apply(&record)
+		offset += int64(4 + len(data))
+	}
+
+	if err := w.file.Truncate(offset); err != nil {
+		return err
+	}
+	w.size = offset
+	_, err := w.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+// Reads the encoding of the next record, or returns nil at the end of the
+// log or at a partial record.
+func (w *wal) next() []byte {
+	var header [4]byte
+	if _, err := io.ReadFull(w.file, header[:]); err != nil {
+		return nil
+	}
+	data := make([]byte, binary.BigEndian.Uint32(header[:]))
+	if _, err := io.ReadFull(w.file, data); err != nil {
+		return nil
+	}
+	return data
+}
+
+// Appends records to the log and syncs them to disk.
+func (w *wal) append(records ...*walRecord) error {
+	data, err := encodeWalRecords(records)
+	if err != nil {
+		return err
+	}
+	if _, err := w.file.Write(data); err != nil {
+		return err
+	}
+	w.size += int64(len(data))
+	return w.file.Sync()
+}
+
+// Atomically replaces the contents of the log with records. Used to drop
+// the history of instances that have been forgotten.
+func (w *wal) rewrite(records []*walRecord) error {
+	data, err := encodeWalRecords(records)
+	if err != nil {
+		return err
+	}
+	data = append(walHeader(), data...)
+
+	path := filepath.Join(w.dir, walFile)
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	w.file.Close()
+	w.file = tmp
+	w.size = int64(len(data))
+
+	// Until the rename is on disk, a crash could bring back the old log,
+	// without the records I go on to append to the new one.
+	return syncDir(w.dir)
+}
+
+func (w *wal) close() {
+	w.file.Close()
+}
+
+// Syncs the entries of dir to disk, so that files created in or renamed
+// into it survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func encodeWalRecords(records []*walRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, record := range records {
+		var data bytes.Buffer
+		if err := gob.NewEncoder(&data).Encode(record); err != nil {
+			return nil, fmt.Errorf("wal: encoding %v record: %v", record.Type, err)
+		}
+		var header [4]byte
+		binary.BigEndian.PutUint32(header[:], uint32(data.Len()))
+		buf.Write(header[:])
+		buf.Write(data.Bytes())
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,115 @@
+package lockservice
+
+import "os"
+import "path/filepath"
+import "reflect"
+import "testing"
+
+// Returns every record of the log in dir, replayed from a fresh open.
+func replayWal(t *testing.T, dir string) []*walRecord {
+	t.Helper()
+	w, err := openWal(dir)
+	if err != nil {
+		t.Fatalf("openWal: %v", err)
+	}
+	defer w.close()
+	var records []*walRecord
+	if err := w.replay(func(record *walRecord) { records = append(records, record) }); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	return records
+}
+
+func testWalRecords() []*walRecord {
+	return []*walRecord{
+		{Type: walPromise, Instance: 3, Proposal: 7},
+		{Type: walInstance, Instance: 3, Info: InstanceInfo{7, 7, []byte("v"), false}},
+		{Type: walDone, Peer: "n1", Done: 2},
+	}
+}
+
+// Records appended to the log are replayed in order after a restart.
+func TestWalReplay(t *testing.T) {
+	dir := t.TempDir()
+	if records := replayWal(t, dir); len(records) != 0 {
+		t.Fatalf("a new log replayed %v", records)
+	}
+
+	w, err := openWal(dir)
+	if err != nil {
+		t.Fatalf("openWal: %v", err)
+	}
+	if err := w.replay(func(*walRecord) {}); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	want := testWalRecords()
+	if err := w.append(want[0]); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if err := w.append(want[1:]...); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	w.close()
+
+	if got := replayWal(t, dir); !reflect.DeepEqual(got, want) {
+		t.Fatalf("replayed %v, want %v", got, want)
+	}
+}
+
+// A record cut short by a crash is dropped on replay, and the records
+// appended after it are replayed on the next restart.
+func TestWalTruncatesPartialRecord(t *testing.T) {
+	dir := t.TempDir()
+	records := testWalRecords()
+	w, err := openWal(dir)
+	if err != nil {
+		t.Fatalf("openWal: %v", err)
+	}
+	if err := w.replay(func(*walRecord) {}); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if err := w.append(records[:2]...); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	w.close()
+
+	// Crash halfway through appending the last record.
+	path := filepath.Join(dir, walFile)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	data, err := encodeWalRecords(records[2:])
+	if err != nil {
+		t.Fatalf("encodeWalRecords: %v", err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	file.Write(data[:len(data)/2])
+	file.Close()
+
+	w, err = openWal(dir)
+	if err != nil {
+		t.Fatalf("openWal: %v", err)
+	}
+	var got []*walRecord
+	if err := w.replay(func(record *walRecord) { got = append(got, record) }); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if !reflect.DeepEqual(got, records[:2]) {
+		t.Fatalf("replayed %v, want %v", got, records[:2])
+	}
+	if truncated, _ := os.Stat(path); truncated.Size() != info.Size() {
+		t.Fatalf("log is %v bytes after replay, want %v", truncated.Size(), info.Size())
+	}
+	if err := w.append(records[2]); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	w.close()
+
+	if got := replayWal(t, dir); !reflect.DeepEqual(got, records) {
+		t.Fatalf("replayed %v, want %v", got, records)
+	}
+}
@@ -0,0 +1,115 @@
+package lockservice
+
+//
+// Watches on locks.
+//
+// Every replica records, for each lock, the instance that last changed
+// who holds it and the instance of the change before that. A client
+// watches a lock by long-polling Watch with the instance of the last
+// change it saw; the reply comes as soon as a later change has been
+// committed, and carries the holders after it. A reply whose Previous
+// isn't the change the client last saw tells it that it missed changes
+// in between.
+//
+// Only the holders of the lock itself are watched: a subtree lock on a
+// lock above it doesn't count as a change.
+//
+
+import "time"
+
+// How long Watch waits for a change before replying Timeout.
+const watchTimeout = 30 * time.Second
+
+// How many instances the last change to a lock nobody holds or waits for
+// is remembered. After that a watcher of the lock is told of its next
+// change with Previous -1, as if changes had been missed.
+const changeRetention = 4096
+
+// The last change to the holders of a lock.
+type Change struct {
+	Instance int // The instance that made the change.
+	Previous int // The instance of the change before, or -1 if none is remembered.
+}
+
+// RPC Handler: Wait until the holders of args.Lock change in an instance
+// after args.After, and reply with the latest change. Replies Timeout if
+// there is none within watchTimeout, after which the client may watch
+// again.
+func (ls *LockService) Watch(args *WatchArgs, reply *WatchReply) error {
+	if !ValidLockName(args.Lock) {
+		reply.Err = BadLockName
+		return nil
+	}
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	timedOut := false
+	timer := ls.sched.AfterFunc(watchTimeout, func() {
+		ls.mu.Lock()
+		timedOut = true
+		ls.changed.Broadcast()
+		ls.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	for ls.lastChange(args.Lock).Instance <= args.After {
+		if ls.dead {
+			reply.Err = ConnectionFailure
+			return nil
+		}
+		if timedOut {
+			reply.Err = Timeout
+			return nil
+		}
+		ls.changed.Wait()
+	}
+
+	reply.Err = OK
+	reply.Event = ls.event(args.Lock)
+	return nil
+}
+
+// Returns the last change to the holders of lock.
+// Precondition: ls.mu is locked.
+func (ls *LockService) lastChange(lock string) Change {
+	if change, changed := ls.changes[lock]; changed {
+		return change
+	}
+	return Change{-1, -1}
+}
+
+// Records that the holders of lock changed in instance ls.max. Releasing
+// a lock and handing it on in one instance is one change.
+// Precondition: ls.mu is locked.
+func (ls *LockService) noteChange(lock string) {
+	change := ls.lastChange(lock)
+	if change.Instance != ls.max {
+		ls.changes[lock] = Change{ls.max, change.Instance}
+	}
+}
+
+// Forgets the last changes to locks that have had no holders or waiters
+// for changeRetention instances.
+// Precondition: ls.mu is locked.
+func (ls *LockService) pruneChanges() {
+	for lock, change := range ls.changes {
+		_, held := ls.locks[lock]
+		inUse := held || len(ls.readers[lock]) > 0 || len(ls.waiters[lock]) > 0
+		if !inUse && ls.max-change.Instance > changeRetention {
+			delete(ls.changes, lock)
+		}
+	}
+}
+
+// Describes the last change to the holders of lock.
+// Precondition: ls.mu is locked.
+func (ls *LockService) event(lock string) Event {
+	change := ls.lastChange(lock)
+	owner, exists := ls.locks[lock]
+	if !exists {
+		owner = Unlocked
+	}
+	readers := append([]int(nil), ls.readers[lock]...)
+	return Event{change.Instance, change.Previous, owner, readers}
+}
@@ -0,0 +1,37 @@
+package main
+
+import "flag"
+import "fmt"
+import "lockservice"
+
+func main() {
+	transport := flag.String("transport", "tcp", "\"tcp\", or \"unix\" for Unix domain socket paths")
+	flag.Parse()
+
+	if flag.NArg() < 3 {
+		printUsage()
+		return
+	}
+	servers := flag.Args()[:flag.NArg()-2]
+	command := flag.Arg(flag.NArg() - 2)
+	peer := flag.Arg(flag.NArg() - 1)
+
+	tr, err := lockservice.MakeNetTransport(*transport)
+	if err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+		return
+	}
+
+	lc := lockservice.MakeLockClient(servers, tr)
+	if command == "add" {
+		fmt.Printf("%v\n", lc.AddPeer(peer))
+	} else if command == "remove" {
+		fmt.Printf("%v\n", lc.RemovePeer(peer))
+	} else {
+		printUsage()
+	}
+}
+
+func printUsage() {
+	fmt.Printf("Usage: admin.go [-transport tcp|unix] <ServerIP:Port>... add|remove <PeerIP:Port>\n")
+}
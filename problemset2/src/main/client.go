@@ -1,26 +1,51 @@
 package main
 
 import "bufio"
+import "flag"
 import "os"
 import "lockservice"
 import "fmt"
 import "strings"
-import "strconv"
+import "time"
 
 func main() {
-	if len(os.Args) <= 1 {
-		fmt.Printf("Usage: client.go <ServerIP:Port>\n")
+	transport := flag.String("transport", "tcp", "\"tcp\", or \"unix\" for a Unix domain socket path")
+	session := flag.Duration("session", 10*time.Second, "session timeout; locks are released if the client stops for this long (0 for no session)")
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		fmt.Printf("Usage: client.go [-transport tcp|unix] [-session <timeout>] <ServerIP:Port>...\n")
+		return
+	}
+	servers := flag.Args()
+
+	tr, err := lockservice.MakeNetTransport(*transport)
+	if err != nil {
+		fmt.Printf("ERROR: %v\n", err)
 		return
 	}
-	server := os.Args[1]
 
-	lc := lockservice.MakeLockClient(server)
+	lc := lockservice.MakeLockClient(servers, tr)
+	if *session > 0 {
+		if err := lc.OpenSession(*session); err != lockservice.OK {
+			fmt.Printf("ERROR: opening session: %v\n", err)
+			return
+		}
+		defer lc.CloseSession()
+	}
 	reader := bufio.NewReader(os.Stdin)
+	watched := make(map[string]int) // map lock name -> instance of the last change printed
 
 	fmt.Printf("\nClient %v initialized\n", lc.ClientId)
 	fmt.Printf("Available Commands:\n")
-	fmt.Printf("  lock <id>\n")
-	fmt.Printf("  unlock <id>\n")
+	fmt.Printf("  lock <name, e.g. /billing/invoices/42> [timeout, e.g. 5s]\n")
+	fmt.Printf("  trylock <name>\n")
+	fmt.Printf("  rlock <name>\n")
+	fmt.Printf("  treelock <name>\n")
+	fmt.Printf("  unlock <name>\n")
+	fmt.Printf("  lease <name> <duration, e.g. 10s>\n")
+	fmt.Printf("  renew <name>\n")
+	fmt.Printf("  watch <name>\n")
 	fmt.Printf("  quit\n\n")
 
 	for {
@@ -38,22 +63,79 @@ func main() {
 
 		inputs := strings.Split(inputString, " ")
 
-		if len(inputs) != 2 {
+		if len(inputs) < 2 {
 			fmt.Printf("Not a valid command.\n")
 			continue
 		}
 
 		command := strings.ToLower(inputs[0])
-		lockId, intErr := strconv.Atoi(inputs[1])
+		name := inputs[1]
 
-		if intErr != nil {
-			fmt.Printf("Bad lockId: %v\n", intErr)
+		if !lockservice.ValidLockName(name) {
+			fmt.Printf("Bad lock name: %v\n", name)
+		} else if command == "lease" && len(inputs) == 3 {
+			lease, durationErr := time.ParseDuration(inputs[2])
+			if durationErr != nil {
+				fmt.Printf("Bad duration: %v\n", durationErr)
+			} else {
+				printLock(lc.LockWithLease(name, lease))
+			}
+		} else if command == "lock" && len(inputs) == 3 {
+			timeout, durationErr := time.ParseDuration(inputs[2])
+			if durationErr != nil {
+				fmt.Printf("Bad duration: %v\n", durationErr)
+			} else {
+				printLock(lc.LockTimeout(name, timeout))
+			}
+		} else if len(inputs) != 2 {
+			fmt.Printf("Not a valid command.\n")
+		} else if command == "trylock" {
+			printLock(lc.TryLock(name))
+		} else if command == "rlock" {
+			printLock(lc.LockShared(name))
+		} else if command == "treelock" {
+			printLock(lc.LockSubtree(name))
+		} else if command == "watch" {
+			after, seen := watched[name]
+			if !seen {
+				after = -1
+			}
+			event, err := lc.Watch(name, after)
+			if err != lockservice.OK {
+				fmt.Printf("%v\n", err)
+			} else {
+				watched[name] = event.Instance
+				printEvent(event, seen && event.Previous != after)
+			}
+		} else if command == "renew" {
+			fmt.Printf("%v\n", lc.Renew(name))
 		} else if command == "lock" {
-			fmt.Printf("%v\n", lc.Lock(lockId))
+			printLock(lc.Lock(name))
 		} else if command == "unlock" {
-			fmt.Printf("%v\n", lc.Unlock(lockId))
+			fmt.Printf("%v\n", lc.Unlock(name))
 		} else {
 			fmt.Printf("Not a valid command.\n")
 		}
 	}
 }
+
+func printLock(token int, err lockservice.Err) {
+	if err == lockservice.OK {
+		fmt.Printf("%v (fencing token %v)\n", err, token)
+	} else {
+		fmt.Printf("%v\n", err)
+	}
+}
+
+func printEvent(event lockservice.Event, missed bool) {
+	if missed {
+		fmt.Printf("(missed changes)\n")
+	}
+	if event.Owner != lockservice.Unlocked {
+		fmt.Printf("instance %v: held by %v\n", event.Instance, event.Owner)
+	} else if len(event.Readers) > 0 {
+		fmt.Printf("instance %v: shared by %v\n", event.Instance, event.Readers)
+	} else {
+		fmt.Printf("instance %v: unlocked\n", event.Instance)
+	}
+}
@@ -1,18 +1,31 @@
 package main
 
+import "flag"
 import "fmt"
 import "lockservice"
-import "os"
 import "strconv"
+import "strings"
 
 func main() {
-	if len(os.Args) <= 2 {
+	dir := flag.String("dir", "", "directory for durable Paxos state (default \"data-<me>\")")
+	transport := flag.String("transport", "tcp", "\"tcp\", or \"unix\" for Unix domain socket paths")
+	join := flag.String("join", "", "join the cluster of this running server instead of starting one")
+	flag.Usage = printUsage
+	flag.Parse()
+	args := flag.Args()
+
+	if *join != "" {
+		joinCluster(*join, args, *dir, *transport)
+		return
+	}
+
+	if len(args) <= 1 {
 		printUsage()
 		return
 	}
 
-	servers := os.Args[1 : len(os.Args)-1]
-	me, err := strconv.Atoi(os.Args[len(os.Args)-1])
+	servers := args[0 : len(args)-1]
+	me, err := strconv.Atoi(args[len(args)-1])
 
 	if me < 0 || me >= len(servers) {
 		printUsage()
@@ -26,9 +39,45 @@ func main() {
 		return
 	}
 
-	lockservice.MakeLockService(servers, me)
+	tr, err := lockservice.MakeNetTransport(*transport)
+	if err != nil {
+		printUsage()
+		fmt.Printf("ERROR: %v\n", err)
+		return
+	}
+
+	if *dir == "" {
+		*dir = fmt.Sprintf("data-%d", me)
+	}
+
+	lockservice.MakeLockService(servers, me, *dir, tr, lockservice.MakeRealScheduler())
+	select {}
+}
+
+// Starts a server that joins the cluster member belongs to.
+func joinCluster(member string, args []string, dir string, transport string) {
+	if len(args) != 1 {
+		printUsage()
+		return
+	}
+	me := args[0]
+
+	tr, err := lockservice.MakeNetTransport(transport)
+	if err != nil {
+		printUsage()
+		fmt.Printf("ERROR: %v\n", err)
+		return
+	}
+
+	if dir == "" {
+		dir = "data-" + strings.NewReplacer(":", "", "/", "_").Replace(me)
+	}
+
+	lockservice.JoinLockService(member, me, dir, tr, lockservice.MakeRealScheduler())
+	select {}
 }
 
 func printUsage() {
-	fmt.Printf("Usage: server.go <ServerIP:Port> ... <ServerIP:Port> <Zero based \"me\" index>\n")
+	fmt.Printf("Usage: server.go [-dir <path>] [-transport tcp|unix] <ServerIP:Port> ... <ServerIP:Port> <Zero based \"me\" index>\n")
+	fmt.Printf("       server.go [-dir <path>] [-transport tcp|unix] -join <MemberIP:Port> <ServerIP:Port>\n")
 }